@@ -17,89 +17,173 @@
 package agent
 
 import (
+	"context"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/satori/go.uuid"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 )
 
 var (
-	buildSession *BuildSession
-	logger       *Logger
-	config       *Config
+	ReconnectInterval = 10 * time.Second
+
+	defaultAgent *Agent
 	AgentId      string
 )
 
-func LogDebug(format string, v ...interface{}) {
-	logger.Debug.Printf(format, v...)
-}
+type Agent struct {
+	Id     string
+	config *Config
+	logger *Logger
+	outbox *Outbox
 
-func LogInfo(format string, v ...interface{}) {
-	logger.Info.Printf(format, v...)
-}
+	state     map[string]string
+	stateLock sync.Mutex
 
-func GetConfig() *Config {
-	return config
+	buildSession *BuildSession
+	sessionLock  sync.Mutex
+	builds       sync.WaitGroup
+	draining     chan bool
+	drainLock    sync.Mutex
+	stop         chan bool
+	stopOnce     sync.Once
 }
 
-func Initialize() {
-	config = LoadConfig()
-	logger = MakeLogger(config.LogDir, "gocd-golang-agent.log", config.OutputDebugLog)
-	LogInfo(">>>>>>> go >>>>>>>")
-	LogInfo("working directory: %v", config.WorkingDir)
+func New(config *Config) (*Agent, error) {
+	logger := MakeLogger(config.LogDir, "gocd-golang-agent.log", config.OutputDebugLog)
+	logger.Info.Printf(">>>>>>> go >>>>>>>")
+	logger.Info.Printf("working directory: %v", config.WorkingDir)
 	if _, err := os.Stat(config.WorkingDir); err != nil {
-		logger.Error.Fatal(err)
+		return nil, err
 	}
 
 	if err := Mkdirs(config.ConfigDir); err != nil {
-		logger.Error.Fatal(err)
+		return nil, err
 	}
+	// secret files left behind by a build interrupted by a crash
+	removeSecretFiles(config.SecretFilesDir, logger)
 
+	var id string
 	if _, err := os.Stat(config.AgentIdFile); err == nil {
 		data, err2 := ioutil.ReadFile(config.AgentIdFile)
 		if err2 != nil {
 			logger.Error.Printf("failed to read uuid file(%v): %v", config.AgentIdFile, err2)
 		} else {
-			AgentId = string(data)
+			id = string(data)
 		}
 	}
-	if AgentId == "" {
-		AgentId = uuid.NewV4().String()
-		ioutil.WriteFile(config.AgentIdFile, []byte(AgentId), 0644)
+	if id == "" {
+		id = uuid.NewV4().String()
+		ioutil.WriteFile(config.AgentIdFile, []byte(id), 0644)
 	}
+
+	return &Agent{
+		Id:       id,
+		config:   config,
+		logger:   logger,
+		outbox:   MakeOutbox(config.OutboxDir, config.SendMessageTimeout, logger),
+		state:    map[string]string{"runtimeStatus": "Idle"},
+		draining: make(chan bool),
+		stop:     make(chan bool),
+	}, nil
+}
+
+func LogDebug(format string, v ...interface{}) {
+	defaultAgent.logger.Debug.Printf(format, v...)
+}
+
+func LogInfo(format string, v ...interface{}) {
+	defaultAgent.logger.Info.Printf(format, v...)
+}
+
+func GetConfig() *Config {
+	return defaultAgent.config
+}
+
+// Initialize creates the agent used by Start, Shutdown and the other
+// package level functions from the environment config.
+func Initialize() {
+	agent, err := New(LoadConfig())
+	if err != nil {
+		panic(err)
+	}
+	defaultAgent = agent
+	AgentId = agent.Id
 }
 
 func Start() error {
-	err := Register()
+	return defaultAgent.serve(context.Background())
+}
+
+// Run keeps the agent connected to the server, reconnecting after
+// ReconnectInterval when the connection is lost, until ctx is done or Stop
+// is called. The current build is canceled when Run returns.
+func (a *Agent) Run(ctx context.Context) error {
+	defer a.cancelBuild()
+	for {
+		err := a.serve(ctx)
+		if err != nil {
+			a.logger.Info.Printf("something wrong: %v", err.Error())
+		}
+		a.logger.Info.Printf("sleep %v and restart", ReconnectInterval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.stop:
+			return nil
+		case <-time.After(ReconnectInterval):
+		}
+	}
+}
+
+func (a *Agent) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+}
+
+func (a *Agent) serve(ctx context.Context) error {
+	err := a.Register()
 	if err != nil {
 		return err
 	}
 
-	httpClient, err := GoServerRemoteClient(true)
+	httpClient, err := a.GoServerRemoteClient(true)
 	if err != nil {
 		return err
 	}
 
-	conn, err := MakeWebsocketConnection(config.WssServerURL(), config.HttpsServerURL())
+	conn, err := a.MakeWebsocketConnection(a.config.WssServerURL(), a.config.HttpsServerURL())
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	defer closeBuildSession()
+	// the build session is not bound to this connection, it keeps running
+	// and its messages wait in the outbox until we are connected again
+	a.outbox.Attach(conn)
+	defer a.outbox.Detach()
 
 	pingTick := time.NewTicker(10 * time.Second)
-	ping(conn.Send)
+	defer pingTick.Stop()
+	a.ping()
 	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.stop:
+			return nil
 		case <-pingTick.C:
-			ping(conn.Send)
+			a.ping()
 		case msg, ok := <-conn.Received:
 			if !ok {
 				return Err("Websocket connection is closed")
 			}
-			err := processMessage(msg, httpClient, conn.Send)
+			err := a.processMessage(msg, httpClient)
 			if err != nil {
 				return err
 			}
@@ -107,66 +191,151 @@ func Start() error {
 	}
 }
 
-func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *protocol.Message) error {
+func (a *Agent) processMessage(msg *protocol.Message, httpClient *http.Client) error {
 	switch msg.Action {
 	case protocol.SetCookieAction:
-		SetState("cookie", msg.DataString())
+		a.SetState("cookie", msg.DataString())
 	case protocol.CancelBuildAction:
-		closeBuildSession()
+		a.closeBuildSession()
 	case protocol.ReregisterAction:
-		CleanRegistration()
+		a.CleanRegistration()
 		return Err("received reregister message")
 	case protocol.BuildAction:
-		closeBuildSession()
 		build := msg.DataBuild()
-		SetState("buildLocator", build.BuildLocator)
-		SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
-		curl, err := config.MakeFullServerURL(build.ConsoleUrl)
+		curl, err := a.config.MakeFullServerURL(build.ConsoleUrl)
 		if err != nil {
 			return err
 		}
-		aurl, err := config.MakeFullServerURL(build.ArtifactUploadBaseUrl)
+		aurl, err := a.config.MakeFullServerURL(build.ArtifactUploadBaseUrl)
 		if err != nil {
 			return err
 		}
-		buildSession = MakeBuildSession(
-			build.BuildId,
-			build.BuildCommand,
-			MakeBuildConsole(httpClient, curl),
-			&Artifacts{httpClient: httpClient},
+		purl, err := a.config.MakeFullServerURL(build.PropertyBaseUrl)
+		if err != nil {
+			return err
+		}
+		if !a.startBuild() {
+			a.rejectBuild(build)
+			return nil
+		}
+		a.closeBuildSession()
+		a.SetState("buildLocator", build.BuildLocator)
+		a.SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
+		artifacts := MakeArtifacts(httpClient, a.logger, a.config.ChecksumAlgorithms...)
+		artifacts.DownloadRetry = a.config.DownloadRetry
+		session := a.makeBuildSession(build,
+			MakeBuildConsole(httpClient, curl, a.logger),
+			artifacts,
+			&Properties{httpClient: httpClient, logger: a.logger, baseURL: purl},
 			aurl,
-			send,
-			config.WorkingDir,
+			a.outbox.Send,
 		)
-		buildSession.ReplaceEcho("${agent.location}", config.WorkingDir)
-		buildSession.ReplaceEcho("${agent.hostname}", config.Hostname)
-		buildSession.ReplaceEcho("${date}", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
-		go processBuild(send, buildSession)
+		a.sessionLock.Lock()
+		a.buildSession = session
+		a.sessionLock.Unlock()
+		go a.processBuild(session)
 	default:
 		panic(Sprintf("Unknown message action: %+v", msg))
 	}
 	return nil
 }
 
-func processBuild(send chan *protocol.Message, buildSession *BuildSession) {
+func (a *Agent) makeBuildSession(build *protocol.Build,
+	console io.WriteCloser,
+	artifacts *Artifacts,
+	properties *Properties,
+	artifactUploadBaseURL *url.URL,
+	send chan *protocol.Message) *BuildSession {
+
+	session := MakeBuildSession(
+		a,
+		build.BuildId,
+		build.BuildCommand,
+		console,
+		artifacts,
+		properties,
+		artifactUploadBaseURL,
+		send,
+		a.config.WorkingDir,
+	)
+	session.AddBuiltin("agent.location", a.config.WorkingDir)
+	session.AddBuiltin("agent.hostname", a.config.Hostname)
+	session.AddBuiltin("date", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
+	return session
+}
+
+// artifactCache returns nil when no artifact cache directory is configured.
+func (a *Agent) artifactCache() *ArtifactCache {
+	if a.config.ArtifactCacheDir == "" {
+		return nil
+	}
+	return MakeArtifactCache(a.config.ArtifactCacheDir, a.config.ArtifactCacheSize, a.config.ArtifactCacheHardLinks, a.logger)
+}
+
+// startBuild counts a new build in unless the agent is draining, Shutdown
+// closes draining under the same lock before it waits for builds.
+func (a *Agent) startBuild() bool {
+	a.drainLock.Lock()
+	defer a.drainLock.Unlock()
+	if isClosedChan(a.draining) {
+		return false
+	}
+	a.builds.Add(1)
+	return true
+}
+
+// rejectBuild reports a build assigned while draining as failed, so that
+// the server does not wait for it to run.
+func (a *Agent) rejectBuild(build *protocol.Build) {
+	a.logger.Error.Printf("agent is shutting down, reject build %v", build.BuildLocator)
+	a.outbox.Send <- protocol.CompletedMessage(&protocol.Report{
+		AgentRuntimeInfo: a.RuntimeInfo(),
+		BuildId:          build.BuildId,
+		Result:           protocol.BuildFailed,
+	})
+}
+
+func (a *Agent) processBuild(buildSession *BuildSession) {
 	defer func() {
-		SetState("runtimeStatus", "Idle")
-		ping(send)
-		logger.Debug.Printf("! exit goroutine: process build command message")
+		a.SetState("runtimeStatus", "Idle")
+		a.ping()
+		a.builds.Done()
+		a.logger.Debug.Printf("! exit goroutine: process build command message")
 	}()
-	SetState("runtimeStatus", "Building")
-	ping(send)
+	a.SetState("runtimeStatus", "Building")
+	a.ping()
 	buildSession.Run()
-	LogInfo("done")
+	a.logger.Info.Printf("done")
+}
+
+func (a *Agent) ping() {
+	a.outbox.Send <- protocol.PingMessage(a.RuntimeInfo())
 }
 
-func ping(send chan *protocol.Message) {
-	send <- protocol.PingMessage(GetAgentRuntimeInfo())
+func (a *Agent) closeBuildSession() {
+	a.sessionLock.Lock()
+	session := a.buildSession
+	a.buildSession = nil
+	a.sessionLock.Unlock()
+	if session != nil {
+		session.Close()
+	}
 }
 
-func closeBuildSession() {
-	if buildSession != nil {
-		buildSession.Close()
-		buildSession = nil
+func (a *Agent) cancelBuild() {
+	a.closeBuildSession()
+	select {
+	case <-a.buildsFinished():
+	case <-time.After(CancelBuildTimeout):
+		a.logger.Error.Printf("build did not stop in %v after it was canceled", CancelBuildTimeout)
 	}
 }
+
+func (a *Agent) buildsFinished() chan bool {
+	finished := make(chan bool)
+	go func() {
+		a.builds.Wait()
+		close(finished)
+	}()
+	return finished
+}
@@ -17,6 +17,7 @@ package agent_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
@@ -56,6 +57,52 @@ func TestSetCookieAfterConnected(t *testing.T) {
 	assert.Equal(t, "agent Idle", stateLog.Next())
 }
 
+func TestRunAnotherAgentInSameProcess(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	workingDir, err := ioutil.TempDir("", "gocd-golang-agent")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(workingDir)
+	defaultWorkingDir := os.Getenv("GOCD_AGENT_WORKING_DIR")
+	os.Setenv("GOCD_AGENT_WORKING_DIR", workingDir)
+	config := LoadConfig()
+	os.Setenv("GOCD_AGENT_WORKING_DIR", defaultWorkingDir)
+
+	another, err := New(config)
+	assert.Nil(t, err)
+	assert.NotEqual(t, AgentId, another.Id)
+	stateLog.Reset(buildId, another.Id)
+	defer stateLog.Reset(buildId, AgentId)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- another.Run(context.Background())
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	goServer.SendBuild(another.Id, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Equal(t, "/builds/"+buildId, another.GetState("buildLocator"))
+	assert.NotEqual(t, "/builds/"+buildId, GetState("buildLocator"))
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+
+	another.Stop()
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -273,6 +320,20 @@ func writeFile(dir, fname, content string) error {
 	return f.Close()
 }
 
+func waitForFile(file string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		if _, err := os.Stat(file); err == nil {
+			return
+		}
+		select {
+		case <-timeout:
+			panic("wait for file timeout: " + file)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
 func pipelineDir() string {
 	return Join("/", os.Getenv("GOCD_AGENT_WORKING_DIR"), pipelineDirRelativePath())
 }
@@ -286,6 +347,50 @@ func relativePath(wd string) string {
 }
 
 func startAgent(t *testing.T) chan bool {
+	done := runAgent(t)
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	return done
+}
+
+// startAnotherAgent runs another agent in its own working directory, so
+// that draining it or changing its outbox does not affect the default agent
+// used by other tests. Messages not acknowledged in 200ms are resent.
+func startAnotherAgent(t *testing.T, id string) (*Agent, *Config, func()) {
+	workingDir, err := ioutil.TempDir("", "gocd-golang-agent")
+	if err != nil {
+		panic(err)
+	}
+	defaultWorkingDir := os.Getenv("GOCD_AGENT_WORKING_DIR")
+	os.Setenv("GOCD_AGENT_WORKING_DIR", workingDir)
+	config := LoadConfig()
+	os.Setenv("GOCD_AGENT_WORKING_DIR", defaultWorkingDir)
+	config.SendMessageTimeout = 200 * time.Millisecond
+
+	a, err := New(config)
+	assert.Nil(t, err)
+	buildId = id
+	stateLog.Reset(buildId, a.Id)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Run(context.Background())
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	return a, config, func() {
+		a.Stop()
+		select {
+		case err := <-stopped:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("agent did not stop")
+		}
+		stateLog.Reset(buildId, AgentId)
+		os.RemoveAll(workingDir)
+	}
+}
+
+func runAgent(t *testing.T) chan bool {
 	done := make(chan bool)
 	go func() {
 		err := Start()
@@ -294,10 +399,17 @@ func startAgent(t *testing.T) chan bool {
 		}
 		close(done)
 	}()
-	assert.Equal(t, "agent Idle", stateLog.Next())
 	return done
 }
 
+func waitForAgentStopped() {
+	select {
+	case <-time.After(5 * time.Second):
+		panic("wait for agent stop timeout")
+	case <-agentStopped:
+	}
+}
+
 func setUp(t *testing.T) {
 	pc, _, _, _ := runtime.Caller(1)
 	_func := runtime.FuncForPC(pc)
@@ -310,11 +422,7 @@ func setUp(t *testing.T) {
 
 func tearDown() {
 	goServer.Send(AgentId, protocol.ReregisterMessage())
-	select {
-	case <-time.After(5 * time.Second):
-		panic("wait for agent stop timeout")
-	case <-agentStopped:
-	}
+	waitForAgentStopped()
 
 	err := os.RemoveAll(pipelineDir())
 	if err != nil {
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+func TestAllowFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "echo scanning licenses; exit 2").SetAllowFailure(true),
+		protocol.ExecCommand("sh", "-c", "echo $GO_LAST_STEP_STATUS"),
+		protocol.ComposeCommand(
+			protocol.FailCommand("vulnerable dependency"),
+			echo("should not echo"),
+		).SetAllowFailure(true),
+		echo("last step ${env:GO_LAST_STEP_STATUS}"),
+		protocol.ExecCommand("true").SetAllowFailure(true),
+		echo("last step ${env:GO_LAST_STEP_STATUS}"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `scanning licenses
+WARN: exec failed, continue because failure is allowed: exit status 2
+failed
+ERROR: vulnerable dependency
+WARN: compose failed, continue because failure is allowed: vulnerable dependency
+last step failed
+last step passed
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestAllowFailureDoesNotHideEarlierFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.FailCommand("build is broken"),
+		protocol.FailCommand("audit failed").SetAllowFailure(true).RunIf("any"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `ERROR: build is broken
+WARN: fail failed, continue because failure is allowed: audit failed
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestAllowFailureOfTimedOutCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").SetTimeout(100*time.Millisecond).SetAllowFailure(true),
+		echo("done"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = maskPids(trimTimestamp(log))
+	assert.True(t, contains(log, "WARN: exec failed, continue because failure is allowed: exec timed out after 100ms\ndone\n"), log)
+}
+
+func TestExecAcceptedExitCodes(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "echo findings; exit 1").AddListArg("acceptedExitCodes", []string{"1", "2"}),
+		protocol.ExecCommand("sh", "-c", "exit 0").AddListArg("acceptedExitCodes", []string{"1"}),
+		protocol.ExecCommand("sh", "-c", "exit 3").AddListArg("acceptedExitCodes", []string{"1", "2"}),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "findings\nERROR: exit status 3\n", trimTimestamp(log))
+}
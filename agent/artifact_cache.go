@@ -0,0 +1,263 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gocd-contrib/gocd-golang-agent/ziputil"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArtifactCacheTmpExpiry is how old files left in the cache tmp directory,
+// e.g. by a crashed agent, have to be before they are removed.
+var ArtifactCacheTmpExpiry = 24 * time.Hour
+
+// ArtifactCache keeps downloaded artifacts by checksum, so that builds
+// downloading the same artifacts into different pipelines on the agent
+// fetch them from Go server only once. Single files are copied into
+// destinations, or hard linked when hardLinks is set, directories are kept
+// as the zip downloaded from the server. The least recently used entries are removed when the
+// cache grows over maxSize bytes. A lock file makes it safe to share the
+// cache directory between agents.
+type ArtifactCache struct {
+	dir       string
+	maxSize   int64
+	hardLinks bool
+	logger    *Logger
+}
+
+func MakeArtifactCache(dir string, maxSize int64, hardLinks bool, logger *Logger) *ArtifactCache {
+	return &ArtifactCache{dir: dir, maxSize: maxSize, hardLinks: hardLinks, logger: logger}
+}
+
+// ArtifactCacheKey returns the cache key of artifact srcPath from its
+// strongest checksums, or "" when it only has md5 checksums, which are not
+// trusted to tell artifacts apart. The key of a directory covers all files
+// in it.
+func ArtifactCacheKey(srcPath string, dir bool, checksums Checksums) string {
+	for _, algorithm := range ChecksumAlgorithms {
+		if algorithm == "md5" {
+			continue
+		}
+		sums := checksums[algorithm]
+		if !dir {
+			if sum, ok := sums[srcPath]; ok {
+				return algorithm + "-" + sum
+			}
+			continue
+		}
+		lines := dirChecksums(srcPath, sums)
+		if len(lines) == 0 || len(lines) != len(dirChecksums(srcPath, checksums["md5"])) {
+			continue
+		}
+		hash := sha256.New()
+		for _, line := range lines {
+			io.WriteString(hash, line+"\n")
+		}
+		return algorithm + "-dir-" + hex.EncodeToString(hash.Sum(nil))
+	}
+	return ""
+}
+
+func dirChecksums(dir string, sums map[string]string) []string {
+	var lines []string
+	for path, sum := range sums {
+		if strings.HasPrefix(path, dir+"/") {
+			lines = append(lines, path[len(dir):]+"="+sum)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Get places the cached artifact of key at destPath, a directory artifact
+// is extracted into the parent of destPath like a download does. It
+// returns false when the cache does not have the artifact.
+func (c *ArtifactCache) Get(key, destPath string, dir bool) (bool, error) {
+	unlock, err := c.lock(false)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	entry := c.entryPath(key)
+	content := filepath.Join(entry, "content")
+	if _, err := os.Stat(content); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if dir {
+		err = ziputil.ExtractFile(content, filepath.Dir(destPath), ziputil.SymlinkInside)
+	} else {
+		err = c.place(content, destPath)
+	}
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	return true, os.Chtimes(entry, now, now)
+}
+
+// Put adds the artifact of key to the cache, download writes it into the
+// given path, directories as zip. The cache lock is not held while
+// downloading.
+func (c *ArtifactCache) Put(key string, download func(path string) error) error {
+	tmpDir := filepath.Join(c.dir, "tmp")
+	if err := Mkdirs(tmpDir); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(tmpDir, key)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := download(filepath.Join(tmp, "content")); err != nil {
+		return err
+	}
+
+	unlock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entry := c.entryPath(key)
+	if _, err := os.Stat(entry); os.IsNotExist(err) {
+		if err := Mkdirs(filepath.Dir(entry)); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, entry); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(entry, now, now); err != nil {
+		return err
+	}
+	return c.evict(key)
+}
+
+// Remove removes the artifact of key, e.g. when it does not match its
+// checksum anymore.
+func (c *ArtifactCache) Remove(key string) error {
+	unlock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.RemoveAll(c.entryPath(key))
+}
+
+func (c *ArtifactCache) entryPath(key string) string {
+	return filepath.Join(c.dir, "entries", key)
+}
+
+func (c *ArtifactCache) lock(exclusive bool) (func(), error) {
+	if err := Mkdirs(c.dir); err != nil {
+		return nil, err
+	}
+	return lockFile(filepath.Join(c.dir, "lock"), exclusive)
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used entries other than the one of key
+// until the cache fits in maxSize, and expired tmp files, it must be called
+// with the exclusive lock.
+func (c *ArtifactCache) evict(key string) error {
+	tmps, _ := ioutil.ReadDir(filepath.Join(c.dir, "tmp"))
+	for _, tmp := range tmps {
+		if time.Since(tmp.ModTime()) > ArtifactCacheTmpExpiry {
+			os.RemoveAll(filepath.Join(c.dir, "tmp", tmp.Name()))
+		}
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(c.dir, "entries"))
+	if err != nil {
+		return err
+	}
+	var entries []cacheEntry
+	var total int64
+	for _, info := range infos {
+		path := filepath.Join(c.dir, "entries", info.Name())
+		content, err := os.Stat(filepath.Join(path, "content"))
+		if err != nil {
+			os.RemoveAll(path)
+			continue
+		}
+		total += content.Size()
+		if info.Name() != key {
+			entries = append(entries, cacheEntry{path, content.Size(), info.ModTime()})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, entry := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		c.logger.Debug.Printf("evict %v from artifact cache", entry.path)
+		if err := os.RemoveAll(entry.path); err != nil {
+			return err
+		}
+		total -= entry.size
+	}
+	return nil
+}
+
+// place replaces dest with a copy of cached file src. With hardLinks it is
+// a hard link instead when src and dest are on the same file system, src
+// is made read-only first as all the links share its content and mode.
+func (c *ArtifactCache) place(src, dest string) error {
+	if err := Mkdirs(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if c.hardLinks {
+		if err := os.Chmod(src, 0444); err != nil {
+			return err
+		}
+		if os.Link(src, dest) == nil {
+			return nil
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
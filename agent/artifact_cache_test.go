@@ -0,0 +1,205 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadDirThroughArtifactCache(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	defer useArtifactCache(t)()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+
+	srcPath := "artifacts/src/hello"
+	log := downloadThroughCache(t, wd, protocol.CommandDownloadDir, srcPath, "dest1")
+	assert.Equal(t, "[artifacts/src/hello] not found in artifact cache, downloading from server.\n", log)
+	// the next download must not need the server
+	err := os.RemoveAll(goServer.ArtifactFile(buildId, "artifacts"))
+	assert.Nil(t, err)
+	log = downloadThroughCache(t, wd, protocol.CommandDownloadDir, srcPath, "dest2")
+	assert.Equal(t, "[artifacts/src/hello] found in artifact cache.\n", log)
+
+	content, err := ioutil.ReadFile(filepath.Join(wd, "dest2/hello/4.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "file created for test", string(content))
+}
+
+func TestDownloadFileThroughArtifactCache(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	defer useArtifactCache(t)()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+
+	srcPath := "artifacts/src/hello/3.txt"
+	log := downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath, "dest1/3.txt")
+	assert.Equal(t, "[artifacts/src/hello/3.txt] not found in artifact cache, downloading from server.\n", log)
+	log = downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath, "dest2/3.txt")
+	assert.Equal(t, "[artifacts/src/hello/3.txt] found in artifact cache.\n", log)
+
+	info1, err := os.Stat(filepath.Join(wd, "dest1/3.txt"))
+	assert.Nil(t, err)
+	info2, err := os.Stat(filepath.Join(wd, "dest2/3.txt"))
+	assert.Nil(t, err)
+	assert.True(t, !os.SameFile(info1, info2), "cached file is copied")
+	assert.Equal(t, os.FileMode(0644), info2.Mode().Perm())
+
+	GetConfig().ArtifactCacheHardLinks = true
+	log = downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath, "dest3/3.txt")
+	assert.Equal(t, "[artifacts/src/hello/3.txt] found in artifact cache.\n", log)
+	entries, err := filepath.Glob(filepath.Join(GetConfig().ArtifactCacheDir, "entries", "*", "content"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	cached, err := os.Stat(entries[0])
+	assert.Nil(t, err)
+	info3, err := os.Stat(filepath.Join(wd, "dest3/3.txt"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(cached, info3), "cached file is hard linked")
+	assert.Equal(t, os.FileMode(0444), info3.Mode().Perm())
+}
+
+func TestDownloadArtifactLargerThanArtifactCache(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	defer useArtifactCache(t)()
+	GetConfig().ArtifactCacheSize = 1
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+
+	srcPath := "artifacts/src/hello"
+	log := downloadThroughCache(t, wd, protocol.CommandDownloadDir, srcPath, "dest1")
+	assert.Equal(t, "[artifacts/src/hello] not found in artifact cache, downloading from server.\n", log)
+	log = downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath+"/3.txt", "dest2/3.txt")
+	assert.Equal(t, "[artifacts/src/hello/3.txt] not found in artifact cache, downloading from server.\n", log)
+	// the directory is evicted for the file added last
+	log = downloadThroughCache(t, wd, protocol.CommandDownloadDir, srcPath, "dest3")
+	assert.Equal(t, "[artifacts/src/hello] not found in artifact cache, downloading from server.\n", log)
+
+	for _, dest := range []string{"dest1/hello/3.txt", "dest2/3.txt", "dest3/hello/3.txt"} {
+		content, err := ioutil.ReadFile(filepath.Join(wd, dest))
+		assert.Nil(t, err)
+		assert.Equal(t, "file created for test", string(content))
+	}
+}
+
+func TestArtifactCacheRemovesEntriesNotMatchingChecksum(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	defer useArtifactCache(t)()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+
+	srcPath := "artifacts/src/hello/3.txt"
+	downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath, "dest1/3.txt")
+	// a copy modified in place does not change the cache entry
+	err := ioutil.WriteFile(filepath.Join(wd, "dest1/3.txt"), []byte("changed"), 0644)
+	assert.Nil(t, err)
+	log := downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath, "dest2/3.txt")
+	assert.Equal(t, "[artifacts/src/hello/3.txt] found in artifact cache.\n", log)
+
+	entries, err := filepath.Glob(filepath.Join(GetConfig().ArtifactCacheDir, "entries", "*", "content"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	err = ioutil.WriteFile(entries[0], []byte("changed"), 0644)
+	assert.Nil(t, err)
+
+	log = downloadThroughCache(t, wd, protocol.CommandDownloadFile, srcPath, "dest3/3.txt")
+	assert.Equal(t, `WARN: Artifact cache entry of artifacts/src/hello/3.txt does not match checksum, removing it
+[artifacts/src/hello/3.txt] not found in artifact cache, downloading from server.
+`, log)
+	content, err := ioutil.ReadFile(filepath.Join(wd, "dest3/3.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "file created for test", string(content))
+}
+
+func TestArtifactCacheEvictsLeastRecentlyUsedEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cache := MakeArtifactCache(dir, 25, false, MakeWriterLogger(ioutil.Discard, false))
+	put := func(key string) {
+		err := cache.Put(key, func(path string) error {
+			return ioutil.WriteFile(path, []byte("0123456789"), 0644)
+		})
+		assert.Nil(t, err)
+	}
+	get := func(key string) bool {
+		hit, err := cache.Get(key, filepath.Join(dir, "out", key), false)
+		assert.Nil(t, err)
+		return hit
+	}
+
+	put("a")
+	put("b")
+	assert.True(t, get("a"))
+	put("c")
+	assert.True(t, get("a"))
+	assert.True(t, !get("b"), "least recently used entry is evicted")
+	assert.True(t, get("c"))
+}
+
+func TestArtifactCacheKey(t *testing.T) {
+	checksums := Checksums{
+		"md5":    {"a/b/1.txt": "m1", "a/b/2.txt": "m2"},
+		"sha256": {"a/b/1.txt": "s1", "a/b/2.txt": "s2"},
+	}
+	assert.Equal(t, "sha256-s1", ArtifactCacheKey("a/b/1.txt", false, checksums))
+	dirKey := ArtifactCacheKey("a/b", true, checksums)
+	assert.True(t, len(dirKey) > 0, dirKey)
+	assert.Equal(t, dirKey, ArtifactCacheKey("a/b", true, checksums))
+
+	checksums["sha256"]["a/b/2.txt"] = "s3"
+	assert.NotEqual(t, dirKey, ArtifactCacheKey("a/b", true, checksums))
+	delete(checksums["sha256"], "a/b/2.txt")
+	assert.Equal(t, "", ArtifactCacheKey("a/b", true, checksums), "not all files have strong checksums")
+	delete(checksums, "sha256")
+	assert.Equal(t, "", ArtifactCacheKey("a/b/1.txt", false, checksums), "md5 is not used as cache key")
+}
+
+func useArtifactCache(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	assert.Nil(t, err)
+	GetConfig().ArtifactCacheDir = dir
+	GetConfig().ArtifactCacheSize = 1024 * 1024
+	return func() {
+		GetConfig().ArtifactCacheDir = ""
+		GetConfig().ArtifactCacheHardLinks = false
+		os.RemoveAll(dir)
+	}
+}
+
+func downloadThroughCache(t *testing.T, wd, name, srcPath, dest string) string {
+	os.Truncate(goServer.ConsoleLogFile(buildId), 0)
+	cmd := protocol.DownloadCommand(name, srcPath, goServer.ArtifactUrl(buildId, srcPath), dest,
+		goServer.ChecksumUrl(buildId), Sprintf("build-%v.md5", buildId))
+	goServer.SendBuild(AgentId, buildId, cmd.Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	return trimTimestamp(log)
+}
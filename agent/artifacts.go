@@ -19,6 +19,11 @@ package agent
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"github.com/gocd-contrib/gocd-golang-agent/ziputil"
+	"hash"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
@@ -31,148 +36,137 @@ import (
 	"time"
 )
 
+// Artifacts uploads to and downloads from Go server, when localDir is set
+// uploaded artifacts are saved in it instead and downloads are not
+// supported.
 type Artifacts struct {
 	httpClient *http.Client
+	logger     *Logger
+	localDir   string
+	algorithms []string
+
+	DownloadRetry DownloadRetry
 }
 
-func (u *Artifacts) DownloadFile(source *url.URL, destPath string) (err error) {
-	dir, _ := filepath.Split(destPath)
-	err = Mkdirs(dir)
-	if err != nil {
-		return err
-	}
-	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return
-	}
-	return u.downloadFile(source, destFile)
+// ChecksumAlgorithms are supported checksum algorithms, strongest first.
+var ChecksumAlgorithms = []string{"sha512", "sha256", "md5"}
+
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
 }
 
-func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
-	zipfile, err := ioutil.TempFile("", "tmp.zip")
-	if err != nil {
-		return err
-	}
-	defer os.Remove(zipfile.Name())
-	LogDebug("tmp file created for download zipped dir")
-	err = u.downloadFile(source, zipfile)
-	if err != nil {
-		return err
-	}
+// Checksums of artifacts, by algorithm and then by artifact path.
+type Checksums map[string]map[string]string
 
-	zipReader, err := zip.OpenReader(zipfile.Name())
-	if err != nil {
-		return err
-	}
-	LogDebug("unzip to %v", destPath)
-	defer zipReader.Close()
-	destDir := filepath.Dir(destPath)
-	for _, file := range zipReader.File {
-		dest := filepath.Join(destDir, file.FileHeader.Name)
-		if file.FileHeader.FileInfo().IsDir() {
-			LogDebug("mkdirs %v", dest)
-			err = Mkdirs(dest)
-		} else {
-			LogDebug("extract file %v => %v", file.FileHeader.Name, dest)
-			err = u.extractFile(file, dest)
-		}
-		if err != nil {
-			return err
-		}
-	}
-	LogDebug("unzip finished")
-	return nil
+// MakeArtifacts makes Artifacts uploading checksums of the algorithms,
+// md5 is always uploaded for Go servers not knowing the others.
+func MakeArtifacts(httpClient *http.Client, logger *Logger, algorithms ...string) *Artifacts {
+	return &Artifacts{httpClient: httpClient, logger: logger, algorithms: algorithms, DownloadRetry: DefaultDownloadRetry}
+}
+
+func (u *Artifacts) unzip(zipfile, destDir string) error {
+	u.logger.Debug.Printf("unzip to %v", destDir)
+	return ziputil.ExtractFile(zipfile, destDir, ziputil.SymlinkInside)
 }
 
-func (u *Artifacts) downloadFile(source *url.URL, destFile *os.File) (err error) {
-	defer destFile.Close()
-	LogDebug("download file %v => %v", source, destFile.Name())
-	retry := 0
-startDownload:
+// FetchChecksums downloads checksums of an algorithm, it returns nil when
+// the server does not have them.
+func (u *Artifacts) FetchChecksums(source *url.URL, algorithm string) (map[string]string, error) {
 	resp, err := u.httpClient.Get(source.String())
 	if err != nil {
-		return
-	}
-	LogDebug("response: %v", resp.Status)
-	if resp.StatusCode == http.StatusAccepted {
-		LogDebug("Server responsed StatusAccepted, sleep 1 sec and start download again")
-		time.Sleep(1 * time.Second)
-		goto startDownload
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		if retry < 3 {
-			retry++
-			LogDebug("sleep %v sec and start download again", retry)
-			time.Sleep(time.Duration(retry) * time.Second)
-			goto startDownload
-		} else {
-			return Err("tried %v times to download [%v] and all failed.", retry, source)
+		u.logger.Debug.Printf("no %v checksums at %v: %v", algorithm, source, resp.Status)
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	checksums := ParseChecksum(string(body))
+	// servers not knowing the algorithm may respond md5 checksums instead
+	size := checksumHashes[algorithm]().Size() * 2
+	for _, checksum := range checksums {
+		if len(checksum) != size {
+			u.logger.Debug.Printf("invalid %v checksums at %v", algorithm, source)
+			return nil, nil
 		}
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(destFile, resp.Body)
-	return
+	return checksums, nil
 }
 
-func (u *Artifacts) VerifyChecksum(srcPath, destPath, checksumFname string) error {
+// VerifyChecksum verifies downloaded files with the strongest checksum
+// available for each of them, it returns the files only verified by md5.
+// With requireStrong files without a stronger checksum than md5 fail the
+// verification.
+func (u *Artifacts) VerifyChecksum(srcPath, destPath string, checksums Checksums, requireStrong bool) (md5Only []string, err error) {
+	verify := func(srcFname, fname string) error {
+		algorithm, err := u.VerifyChecksumFile(srcFname, fname, checksums)
+		if err == nil && algorithm == "md5" {
+			if requireStrong {
+				return Err("[ERROR] Only md5 checksum of the artifact [%v] is available, which is not accepted to verify the integrity of its contents.", srcFname)
+			}
+			md5Only = append(md5Only, srcFname)
+		}
+		return err
+	}
 	destInfo, err := os.Stat(destPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if destInfo.IsDir() {
-		return filepath.Walk(destPath, func(path string, info os.FileInfo, err error) error {
+		err = filepath.Walk(destPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
+			if info.IsDir() || isDirSymlink(path, info) {
 				return nil
 			}
 			srcFname := Join("/", srcPath, path[len(destPath)+1:])
-			return u.VerifyChecksumFile(srcFname, path, checksumFname)
+			return verify(srcFname, path)
 		})
 	} else {
-		return u.VerifyChecksumFile(srcPath, destPath, checksumFname)
+		err = verify(srcPath, destPath)
 	}
+	return md5Only, err
 }
 
-func (u *Artifacts) VerifyChecksumFile(srcFname, fname, checksumFname string) error {
-	md5, err := ComputeMd5(fname)
-	if err != nil {
-		return err
-	}
-	checksum, err := ioutil.ReadFile(checksumFname)
-	if err != nil {
-		return err
-	}
-	properties := ParseChecksum(string(checksum))
+// VerifyChecksumFile verifies a file with the strongest algorithm of
+// checksums having its checksum and returns the algorithm.
+func (u *Artifacts) VerifyChecksumFile(srcFname, fname string, checksums Checksums) (string, error) {
 	// Convert path used as key name in properties, because md5.checksum always has unix / slashes
-	srcFname=filepath.ToSlash(srcFname)
-	if properties[srcFname] == "" {
-		return Err("[WARN] The md5checksum value of the artifact [%v] was not found on the server. Hence, Go could not verify the integrity of its contents.", srcFname)
-	} else if properties[srcFname] != md5 {
-		return Err("[ERROR] Verification of the integrity of the artifact [%v] failed. The artifact file on the server may have changed since its original upload.", srcFname)
-	} else {
-		return nil
+	srcFname = filepath.ToSlash(srcFname)
+	for _, algorithm := range ChecksumAlgorithms {
+		expected := checksums[algorithm][srcFname]
+		if expected == "" {
+			continue
+		}
+		actual, err := ComputeChecksums(fname, []string{algorithm})
+		if err != nil {
+			return "", err
+		}
+		if actual[algorithm] != expected {
+			return "", Err("[ERROR] Verification of the integrity of the artifact [%v] failed. The artifact file on the server may have changed since its original upload.", srcFname)
+		}
+		return algorithm, nil
 	}
+	return "", Err("[WARN] The md5checksum value of the artifact [%v] was not found on the server. Hence, Go could not verify the integrity of its contents.", srcFname)
 }
 
 func (u *Artifacts) Upload(source, destPath string, destURL *url.URL) (err error) {
-	zipped, checksum, err := u.zipSource(source, destPath)
+	zipped, checksums, err := u.zipSource(source, destPath)
 	defer os.Remove(zipped)
 	if err != nil {
 		return
 	}
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-	err = u.writeFilePart(writer, zipped, "zipfile")
-	if err != nil {
-		return
-	}
-	err = u.writePart(writer, bytes.NewBufferString(checksum), "file_checksum", "checksum_file")
-	if err != nil {
-		return
+	if u.localDir != "" {
+		return u.unzip(zipped, u.localDir)
 	}
-	err = writer.Close()
+	body, err := makeUploadBody(zipped, checksums)
 	if err != nil {
 		return
 	}
@@ -180,7 +174,7 @@ func (u *Artifacts) Upload(source, destPath string, destURL *url.URL) (err error
 	attempt := 1
 tryPost:
 	attemptUrl := AppendUrlParam(destURL, "attempt", strconv.Itoa(attempt))
-	statusCode, err := u.post(source, writer.FormDataContentType(), attemptUrl, &body)
+	statusCode, err := u.post(source, attemptUrl, body)
 	// client side errors, no retry
 	if err != nil {
 		return
@@ -191,8 +185,7 @@ tryPost:
 	}
 	// handle errors
 	if statusCode == http.StatusRequestEntityTooLarge {
-		info, _ := os.Stat(zipped)
-		return Err("Artifact upload for file %s (Size: %d) was denied by the server. This usually happens when server runs out of disk space.", source, info.Size())
+		return Err("Artifact upload for file %s (Size: %d) was denied by the server. This usually happens when server runs out of disk space.", source, body.zipSize)
 	}
 	// retry for other errors
 	if attempt < 3 {
@@ -202,50 +195,118 @@ tryPost:
 	return Err("Failed to upload %v. Server response: %v", source, statusCode)
 }
 
-func (u *Artifacts) post(source, contentType string, destURL *url.URL, body *bytes.Buffer) (statusCode int, err error) {
-	req, err := http.NewRequest("POST", destURL.String(), body)
+func (u *Artifacts) post(source string, destURL *url.URL, body *uploadBody) (statusCode int, err error) {
+	reader, err := body.open()
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", destURL.String(), reader)
 	if err != nil {
+		reader.Close()
 		return
 	}
-	req.Header.Add("Content-Type", contentType)
-	req.Header.Add("Confirm","true")
+	req.ContentLength = body.size()
+	req.GetBody = body.open
+	req.Header.Add("Content-Type", body.contentType)
+	req.Header.Add("Confirm", "true")
 
 	resp, err := u.httpClient.Do(req)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
 	return resp.StatusCode, nil
 }
 
-func (u *Artifacts) writeFilePart(writer *multipart.Writer, path, paramName string) error {
-	file, err := os.Open(path)
+// uploadBody is the multipart form of a zip file and its checksum, the zip
+// file is streamed from disk for each attempt, so that memory use does not
+// grow with the artifact size.
+type uploadBody struct {
+	contentType string
+	head        []byte
+	zipfile     string
+	zipSize     int64
+	tail        []byte
+}
+
+// makeUploadBody makes the form with checksums by algorithm, md5 ones
+// are the file_checksum field Go server verifies and the others are
+// file_checksum_<algorithm> fields.
+func makeUploadBody(zipfile string, checksums map[string]string) (*uploadBody, error) {
+	info, err := os.Stat(zipfile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if _, err := writer.CreateFormFile("zipfile", filepath.Base(zipfile)); err != nil {
+		return nil, err
 	}
-	defer file.Close()
-	return u.writePart(writer, file, paramName, filepath.Base(path))
+	head := append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	for _, algorithm := range ChecksumAlgorithms {
+		checksum, ok := checksums[algorithm]
+		if !ok {
+			continue
+		}
+		fieldname, filename := "file_checksum", "checksum_file"
+		if algorithm != "md5" {
+			fieldname += "_" + algorithm
+			filename += "_" + algorithm
+		}
+		part, err := writer.CreateFormFile(fieldname, filename)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(part, checksum); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return &uploadBody{
+		contentType: writer.FormDataContentType(),
+		head:        head,
+		zipfile:     zipfile,
+		zipSize:     info.Size(),
+		tail:        buf.Bytes(),
+	}, nil
+}
+
+func (b *uploadBody) size() int64 {
+	return int64(len(b.head)) + b.zipSize + int64(len(b.tail))
 }
 
-func (u *Artifacts) writePart(writer *multipart.Writer, src io.Reader, fieldname, filename string) error {
-	part, err := writer.CreateFormFile(fieldname, filename)
+func (b *uploadBody) open() (io.ReadCloser, error) {
+	file, err := os.Open(b.zipfile)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = io.Copy(part, src)
-	return err
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b.head), file, bytes.NewReader(b.tail)), file}, nil
 }
 
-func (u *Artifacts) zipSource(source string, dest string) (string, string, error) {
+// zipSource zips source as dest and returns the zip file with checksum
+// files of its entries by algorithm.
+func (u *Artifacts) zipSource(source string, dest string) (string, map[string]string, error) {
 	zipfile, err := ioutil.TempFile("", "tmp.zip")
 	if err != nil {
-		return "", "", err
+		return "", nil, err
 	}
 	defer zipfile.Close()
 	w := zip.NewWriter(zipfile)
 	defer w.Close()
 
-	var checksum bytes.Buffer
-	checksum.WriteString(Sprintf("#\n#%v\n", time.Now()))
+	algorithms := append([]string{"md5"}, u.algorithms...)
+	checksums := make(map[string]*bytes.Buffer, len(algorithms))
+	header := Sprintf("#\n#%v\n", time.Now())
+	for _, algorithm := range algorithms {
+		checksums[algorithm] = bytes.NewBufferString(header)
+	}
 	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -270,44 +331,28 @@ func (u *Artifacts) zipSource(source string, dest string) (string, string, error
 		}
 		// Convert slash to Linux slash especally on Windows
 		destFile=filepath.ToSlash(destFile)
-		md5, err := ComputeMd5(path)
-		if err != nil {
-			return err
-		}
-		checksum.WriteString(Sprintf("%v=%v\n", destFile, md5))
-
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		writer, err := w.Create(destFile)
-		if err != nil {
-			return err
+		if !isDirSymlink(path, info) {
+			sums, err := ComputeChecksums(path, algorithms)
+			if err != nil {
+				return err
+			}
+			for algorithm, sum := range sums {
+				checksums[algorithm].WriteString(Sprintf("%v=%v\n", destFile, sum))
+			}
 		}
-
-		_, err = io.Copy(writer, file)
-		return err
+		return ziputil.Add(w, path, destFile)
 	})
-	return zipfile.Name(), checksum.String(), err
-}
-
-func (u *Artifacts) extractFile(file *zip.File, dest string) error {
-	rc, err := file.Open()
-	if err != nil {
-		return err
+	files := make(map[string]string, len(checksums))
+	for algorithm, checksum := range checksums {
+		files[algorithm] = checksum.String()
 	}
-	defer rc.Close()
+	return zipfile.Name(), files, err
+}
 
-	err = os.MkdirAll(filepath.Dir(dest), 0755)
-	if err != nil {
-		return err
-	}
-	destFile, err := os.Create(dest)
-	if err != nil {
-		return err
+func isDirSymlink(path string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
 	}
-	defer destFile.Close()
-	_, err = io.Copy(destFile, rc)
-	return err
+	target, err := os.Stat(path)
+	return err == nil && target.IsDir()
 }
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadSha256Checksums(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+
+	checksums, err := ComputeChecksums(filepath.Join(wd, "src/hello/3.txt"), []string{"sha256"})
+	assert.Nil(t, err)
+	sha256, err := goServer.AlgorithmChecksum(buildId, "sha256")
+	assert.Nil(t, err)
+	assert.True(t, contains(sha256, "\nartifacts/src/hello/3.txt="+checksums["sha256"]+"\n"), sha256)
+	md5, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(md5, "\nartifacts/src/hello/3.txt=41e43efb30d3fbfcea93542157809ac0\n"), md5)
+}
+
+func TestDownloadVerifiesSha256ChecksumsFirst(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+	// md5 checksums are ignored when stronger ones are available
+	err := ioutil.WriteFile(goServer.ChecksumFile(buildId), []byte("artifacts/src/hello/3.txt=0123\n"), 0644)
+	assert.Nil(t, err)
+
+	log := downloadArtifactDir(t, wd, "build Passed")
+	assert.Equal(t, "", log)
+}
+
+func TestDownloadFallsBackToMd5ChecksumsWithWarning(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+	err := os.Remove(goServer.AlgorithmChecksumFile(buildId, "sha256"))
+	assert.Nil(t, err)
+
+	log := downloadArtifactDir(t, wd, "build Passed")
+	assert.Equal(t, "WARN: Only md5 checksums are available to verify artifacts/src/hello/3.txt, artifacts/src/hello/4.txt\n", log)
+}
+
+func TestDownloadFailsWithOnlyMd5ChecksumsWhenStrongChecksumsAreRequired(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	GetConfig().RequireStrongChecksums = true
+	defer func() { GetConfig().RequireStrongChecksums = false }()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+	err := os.Remove(goServer.AlgorithmChecksumFile(buildId, "sha256"))
+	assert.Nil(t, err)
+
+	log := downloadArtifactDir(t, wd, "build Failed")
+	assert.True(t, strings.HasPrefix(log, "ERROR: [ERROR] Only md5 checksum of the artifact [artifacts/src/hello/"), log)
+}
+
+func TestDownloadFailsWhenSha256ChecksumMismatches(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	uploadArtifacts(t, wd)
+	sha256 := strings.Repeat("0", 64)
+	err := ioutil.WriteFile(goServer.AlgorithmChecksumFile(buildId, "sha256"), []byte("artifacts/src/hello/3.txt="+sha256+"\n"), 0644)
+	assert.Nil(t, err)
+
+	log := downloadArtifactDir(t, wd, "build Failed")
+	assert.True(t, strings.HasPrefix(log, "ERROR: [ERROR] Verification of the integrity of the artifact [artifacts/src/hello/3.txt] failed."), log)
+}
+
+func uploadArtifacts(t *testing.T, wd string) {
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	os.Truncate(goServer.ConsoleLogFile(buildId), 0)
+}
+
+func downloadArtifactDir(t *testing.T, wd, result string) string {
+	srcPath := "artifacts/src/hello"
+	cmd := protocol.DownloadDirCommand(srcPath, goServer.ArtifactUrl(buildId, srcPath), "dest",
+		goServer.ChecksumUrl(buildId), Sprintf("build-%v.md5", buildId))
+	goServer.SendBuild(AgentId, buildId, cmd.Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, result, stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	return trimTimestamp(log)
+}
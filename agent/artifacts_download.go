@@ -0,0 +1,292 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadRetry is how a failed download is retried: up to Attempts
+// attempts, sleeping Backoff after the first failure and doubling it after
+// each one up to MaxBackoff. Downloads interrupted by transport errors are
+// resumed from where they stopped.
+type DownloadRetry struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultDownloadRetry = DownloadRetry{Attempts: 4, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+
+var (
+	// Progress of downloads larger than DownloadProgressMinSize bytes is
+	// reported every DownloadProgressInterval.
+	DownloadProgressMinSize  int64 = 10 * 1024 * 1024
+	DownloadProgressInterval       = 10 * time.Second
+)
+
+// DownloadProgress reports progress of large downloads, e.g. into the
+// build console log.
+type DownloadProgress func(format string, a ...interface{})
+
+var errDownloadAccepted = errors.New("server accepted download request")
+
+// DownloadFile downloads source into a temporary file next to destPath,
+// which replaces destPath once the download completes. progress may be nil,
+// closing cancel stops waiting to retry.
+func (u *Artifacts) DownloadFile(source *url.URL, destPath string, progress DownloadProgress, cancel <-chan bool) error {
+	if u.localDir != "" {
+		return Err("can not download %v without Go server", source)
+	}
+	return u.downloadFile(source, destPath, progress, cancel)
+}
+
+// DownloadDir downloads zipped directory source and extracts it into the
+// parent directory of destPath.
+func (u *Artifacts) DownloadDir(source *url.URL, destPath string, progress DownloadProgress, cancel <-chan bool) error {
+	if u.localDir != "" {
+		return Err("can not download %v without Go server", source)
+	}
+	tmpDir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	zipfile := filepath.Join(tmpDir, "artifact.zip")
+	if err := u.downloadFile(source, zipfile, progress, cancel); err != nil {
+		return err
+	}
+	return u.unzip(zipfile, filepath.Dir(destPath))
+}
+
+func (u *Artifacts) downloadFile(source *url.URL, destPath string, progress DownloadProgress, cancel <-chan bool) (err error) {
+	dir, name := filepath.Split(destPath)
+	if err = Mkdirs(dir); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".download")
+	if err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	u.logger.Debug.Printf("download file %v => %v", source, tmp.Name())
+
+	w := &downloadWriter{file: tmp, source: source, progress: progress, started: time.Now()}
+	retry := u.DownloadRetry
+	backoff := retry.Backoff
+	for attempt := 1; ; {
+		err = u.fetch(source, w)
+		if err == nil {
+			break
+		}
+		if err == errDownloadAccepted {
+			u.logger.Debug.Printf("Server responsed StatusAccepted, sleep 1 sec and start download again")
+			select {
+			case <-cancel:
+				return Err("download of %v canceled", source)
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+		if attempt >= retry.Attempts {
+			return Err("tried %v times to download [%v] and all failed: %v", attempt, source, err)
+		}
+		u.logger.Debug.Printf("download %v failed: %v, sleep %v and resume from byte %v", source, err, backoff, w.written)
+		w.report("Download of %v failed: %v, resume from byte %v in %v\n", source, err, w.written, backoff)
+		select {
+		case <-cancel:
+			return Err("download of %v canceled", source)
+		case <-time.After(backoff):
+		}
+		attempt++
+		backoff *= 2
+		if retry.MaxBackoff > 0 && backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+	w.done()
+	if err = tmp.Chmod(0644); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), destPath)
+}
+
+// fetch writes source into w, requesting only the bytes after the ones
+// written by previous attempts if they are still the same on the server.
+func (u *Artifacts) fetch(source *url.URL, w *downloadWriter) error {
+	req, err := http.NewRequest("GET", source.String(), nil)
+	if err != nil {
+		return err
+	}
+	if w.written > 0 && w.validator != "" {
+		req.Header.Set("Range", Sprintf("bytes=%v-", w.written))
+		req.Header.Set("If-Range", w.validator)
+	}
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	u.logger.Debug.Printf("response: %v", resp.Status)
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return errDownloadAccepted
+	case http.StatusOK:
+		// the server does not support ranges, start over
+		if err := w.reset(); err != nil {
+			return err
+		}
+		w.total = resp.ContentLength
+		w.validator = rangeValidator(resp.Header)
+	case http.StatusPartialContent:
+		start, total := parseContentRange(resp.Header.Get("Content-Range"))
+		if start != w.written {
+			if err := w.reset(); err != nil {
+				return err
+			}
+			return Err("unexpected content range %v", resp.Header.Get("Content-Range"))
+		}
+		w.total = total
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			if err := w.reset(); err != nil {
+				return err
+			}
+		}
+		return Err("server responded %v", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// rangeValidator returns the strong ETag or Last-Modified of a response,
+// which If-Range needs to resume a download only when the content did not
+// change. Without them a download is not resumed but started over.
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// parseContentRange returns first byte position and complete length of
+// Content-Range "bytes first-last/length", length is -1 when unknown.
+func parseContentRange(contentRange string) (int64, int64) {
+	r := strings.TrimPrefix(contentRange, "bytes ")
+	i := strings.Index(r, "-")
+	j := strings.Index(r, "/")
+	if i < 0 || j < i {
+		return -1, -1
+	}
+	start, err := strconv.ParseInt(r[:i], 10, 64)
+	if err != nil {
+		return -1, -1
+	}
+	total, err := strconv.ParseInt(r[j+1:], 10, 64)
+	if err != nil {
+		return start, -1
+	}
+	return start, total
+}
+
+// downloadWriter writes a download into file, reporting its progress.
+type downloadWriter struct {
+	file      *os.File
+	source    *url.URL
+	progress  DownloadProgress
+	written   int64
+	total     int64
+	validator string
+	started   time.Time
+	reported  time.Time
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	if w.written >= DownloadProgressMinSize && time.Since(w.started) >= DownloadProgressInterval &&
+		time.Since(w.reported) >= DownloadProgressInterval {
+		w.reported = time.Now()
+		if w.total > 0 {
+			w.report("Downloaded %v of %v (%v%%) from %v, %v/s\n", formatBytes(w.written), formatBytes(w.total),
+				w.written*100/w.total, w.source, formatBytes(w.throughput()))
+		} else {
+			w.report("Downloaded %v from %v, %v/s\n", formatBytes(w.written), w.source, formatBytes(w.throughput()))
+		}
+	}
+	return n, err
+}
+
+func (w *downloadWriter) reset() error {
+	w.written = 0
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *downloadWriter) done() {
+	if w.written >= DownloadProgressMinSize {
+		w.report("Downloaded %v from %v in %v, %v/s\n", formatBytes(w.written), w.source,
+			time.Since(w.started).Round(time.Millisecond), formatBytes(w.throughput()))
+	}
+}
+
+func (w *downloadWriter) throughput() int64 {
+	seconds := time.Since(w.started).Seconds()
+	if seconds <= 0 {
+		return w.written
+	}
+	return int64(float64(w.written) / seconds)
+}
+
+func (w *downloadWriter) report(format string, a ...interface{}) {
+	if w.progress != nil {
+		w.progress(format, a...)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return Sprintf("%v B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
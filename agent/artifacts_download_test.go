@@ -0,0 +1,210 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var quickRetry = DownloadRetry{Attempts: 3, Backoff: time.Millisecond}
+
+func TestDownloadResumesAfterConnectionReset(t *testing.T) {
+	content, dir := downloadContent(t)
+	defer os.RemoveAll(dir)
+	server, ranges := serveInterrupted(content, content, true)
+	defer server.Close()
+
+	dest := filepath.Join(dir, "dest.bin")
+	err := makeDownloadArtifacts().DownloadFile(parseURL(server.URL), dest, nil, nil)
+	assert.Nil(t, err)
+
+	downloaded, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, downloaded), "downloaded content")
+	assert.Equal(t, []string{" ", Sprintf("bytes=%v- \"v1\"", len(content)/2)}, *ranges)
+}
+
+func TestDownloadStartsOverWhenContentChangedOnServer(t *testing.T) {
+	content, dir := downloadContent(t)
+	defer os.RemoveAll(dir)
+	changed := bytes.Repeat([]byte("x"), len(content))
+	server, ranges := serveInterrupted(content, changed, true)
+	defer server.Close()
+
+	dest := filepath.Join(dir, "dest.bin")
+	err := makeDownloadArtifacts().DownloadFile(parseURL(server.URL), dest, nil, nil)
+	assert.Nil(t, err)
+
+	downloaded, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(changed, downloaded), "downloaded content is not stitched from both versions")
+	assert.Equal(t, 2, len(*ranges))
+}
+
+func TestDownloadStartsOverWhenServerIgnoresRange(t *testing.T) {
+	content, dir := downloadContent(t)
+	defer os.RemoveAll(dir)
+	server, ranges := serveInterrupted(content, content, false)
+	defer server.Close()
+	// a longer file is replaced instead of leaving its trailing bytes
+	dest := filepath.Join(dir, "dest.bin")
+	err := ioutil.WriteFile(dest, append(content, content...), 0644)
+	assert.Nil(t, err)
+
+	err = makeDownloadArtifacts().DownloadFile(parseURL(server.URL), dest, nil, nil)
+	assert.Nil(t, err)
+
+	downloaded, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, downloaded), "downloaded content")
+	assert.Equal(t, 2, len(*ranges))
+}
+
+func TestDownloadFailsAfterRetryAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	var reports []string
+	progress := func(format string, a ...interface{}) {
+		reports = append(reports, Sprintf(format, a...))
+	}
+
+	err = makeDownloadArtifacts().DownloadFile(parseURL(server.URL), filepath.Join(dir, "dest.bin"), progress, nil)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "tried 3 times to download"), err.Error())
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 2, len(reports), reports)
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files), "no temporary file is left")
+}
+
+func TestDownloadRetryIsCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	artifacts := makeDownloadArtifacts()
+	artifacts.DownloadRetry = DownloadRetry{Attempts: 3, Backoff: time.Minute}
+	cancel := make(chan bool)
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+
+	started := time.Now()
+	err = artifacts.DownloadFile(parseURL(server.URL), filepath.Join(dir, "dest.bin"), nil, cancel)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), " canceled"), err.Error())
+	assert.True(t, time.Since(started) < 10*time.Second, time.Since(started))
+}
+
+func TestDownloadReportsProgressOfLargeFiles(t *testing.T) {
+	content, dir := downloadContent(t)
+	defer os.RemoveAll(dir)
+	defer func(size int64, interval time.Duration) {
+		DownloadProgressMinSize = size
+		DownloadProgressInterval = interval
+	}(DownloadProgressMinSize, DownloadProgressInterval)
+	DownloadProgressMinSize = 1
+	DownloadProgressInterval = 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+	var reports []string
+	progress := func(format string, a ...interface{}) {
+		reports = append(reports, Sprintf(format, a...))
+	}
+
+	err := makeDownloadArtifacts().DownloadFile(parseURL(server.URL), filepath.Join(dir, "dest.bin"), progress, nil)
+	assert.Nil(t, err)
+	assert.True(t, len(reports) > 1, reports)
+	assert.True(t, strings.HasPrefix(reports[0], "Downloaded "), reports[0])
+	assert.True(t, contains(reports[0], " of 1.0 MiB ("), reports[0])
+	last := reports[len(reports)-1]
+	assert.True(t, strings.HasPrefix(last, "Downloaded 1.0 MiB from "+server.URL+" in "), last)
+}
+
+func downloadContent(t *testing.T) ([]byte, string) {
+	dir, err := ioutil.TempDir("", "download")
+	assert.Nil(t, err)
+	content, err := ioutil.ReadFile(writeRandomFile(t, dir, 1024*1024))
+	assert.Nil(t, err)
+	os.Remove(filepath.Join(dir, "artifact.bin"))
+	return content, dir
+}
+
+// serveInterrupted serves content with ETag "v1", closing the connection of
+// the first request after half of it, and then next with ETag "v2" when it
+// is different. It records Range and If-Range headers of the requests.
+func serveInterrupted(content, next []byte, supportRange bool) (*httptest.Server, *[]string) {
+	var lock sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		first := len(ranges) == 1
+		lock.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		if first {
+			w.Header().Set("Content-Length", Sprintf("%v", len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		if !supportRange {
+			r.Header.Del("Range")
+		}
+		if !bytes.Equal(content, next) {
+			w.Header().Set("ETag", `"v2"`)
+		}
+		http.ServeContent(w, r, "content.bin", time.Now(), bytes.NewReader(next))
+	}))
+	return server, &ranges
+}
+
+func makeDownloadArtifacts() *Artifacts {
+	artifacts := MakeArtifacts(http.DefaultClient, MakeWriterLogger(ioutil.Discard, false))
+	artifacts.DownloadRetry = quickRetry
+	return artifacts
+}
+
+func parseURL(s string) *url.URL {
+	u, _ := url.Parse(s)
+	return u
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -383,6 +384,41 @@ func TestDownloadArtifactDir(t *testing.T) {
 	testDownload(t, wd, "artifacts/src/hello", "dest", []string{"dest/hello/3.txt", "dest/hello/4.txt"}, true)
 }
 
+func TestArtifactRoundTripKeepsModesAndSymlinks(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(filepath.Join(wd, "tools/bin"), "cli", "#!/bin/sh\necho cli\n"))
+	assert.Nil(t, os.Chmod(filepath.Join(wd, "tools/bin/cli"), 0755))
+	assert.Nil(t, os.Symlink("bin/cli", filepath.Join(wd, "tools/cli")))
+
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("tools", "", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	srcUrl := goServer.ArtifactUrl(buildId, "tools")
+	checksumUrl := goServer.ChecksumUrl(buildId)
+	checksumPath := Sprintf("build-%v.md5", buildId)
+	goServer.SendBuild(AgentId, buildId,
+		protocol.DownloadDirCommand("tools", srcUrl, "dest", checksumUrl, checksumPath).Setwd(relativePath(wd)),
+		protocol.ExecCommand("dest/tools/cli").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	info, err := os.Stat(filepath.Join(wd, "dest/tools/bin/cli"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(wd, "dest/tools/cli"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bin/cli", target)
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), "\ncli\n"), log)
+}
+
 func testDownload(t *testing.T, wd, srcPath, destDir string, destFiles []string, sourceIsDir bool) {
 	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
 	assert.Equal(t, "agent Building", stateLog.Next())
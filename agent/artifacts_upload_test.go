@@ -0,0 +1,130 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+const largeArtifactSize = 32 * 1024 * 1024
+
+func TestUploadLargeArtifactWithConstantMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-large-artifact")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := writeRandomFile(t, dir, largeArtifactSize)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	artifacts := MakeArtifacts(http.DefaultClient, MakeWriterLogger(ioutil.Discard, false))
+	destURL, _ := url.Parse(server.URL)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	err = artifacts.Upload(file, "", destURL)
+	runtime.ReadMemStats(&after)
+
+	assert.Nil(t, err)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	assert.True(t, allocated < largeArtifactSize/4, Sprintf("allocated %v bytes to upload %v bytes", allocated, largeArtifactSize))
+}
+
+func TestUploadRetrySendsWholeBodyAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-retry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := writeRandomFile(t, dir, 1024*1024)
+	var lock sync.Mutex
+	var received, contentLengths []int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, n)
+		contentLengths = append(contentLengths, r.ContentLength)
+		if len(received) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	artifacts := MakeArtifacts(http.DefaultClient, MakeWriterLogger(ioutil.Discard, false))
+	destURL, _ := url.Parse(server.URL)
+
+	err = artifacts.Upload(file, "", destURL)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(received))
+	for i := range received {
+		assert.True(t, received[i] > 1024*1024, received[i])
+		assert.Equal(t, received[0], received[i])
+		assert.Equal(t, received[i], contentLengths[i])
+	}
+}
+
+func BenchmarkUploadArtifact(b *testing.B) {
+	dir, err := ioutil.TempDir("", "upload-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeRandomFile(b, dir, 8*1024*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	artifacts := MakeArtifacts(http.DefaultClient, MakeWriterLogger(ioutil.Discard, false))
+	destURL, _ := url.Parse(server.URL)
+
+	b.SetBytes(8 * 1024 * 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := artifacts.Upload(file, "", destURL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func writeRandomFile(t testing.TB, dir string, size int) string {
+	path := filepath.Join(dir, "artifact.bin")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.New(rand.NewSource(1)), int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -32,6 +32,7 @@ type BuildConsole struct {
 	stop       chan bool
 	closed     chan bool
 	write      chan []byte
+	logger     *Logger
 }
 
 func timestampPrefix() []byte {
@@ -39,7 +40,7 @@ func timestampPrefix() []byte {
 	return []byte(ts)
 }
 
-func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
+func MakeBuildConsole(httpClient *http.Client, url *url.URL, logger *Logger) *BuildConsole {
 	console := BuildConsole{
 		HttpClient: httpClient,
 		Url:        url,
@@ -48,11 +49,12 @@ func MakeBuildConsole(httpClient *http.Client, url *url.URL) *BuildConsole {
 		stop:   make(chan bool),
 		closed: make(chan bool),
 		write:  make(chan []byte),
+		logger: logger,
 	}
 	go func() {
 		defer func() {
 			close(console.closed)
-			LogInfo("build console closed")
+			logger.Info.Printf("build console closed")
 		}()
 		tw := stream.NewPrefixWriter(console.buffer, timestampPrefix)
 		flushTick := time.NewTicker(5 * time.Second)
@@ -86,7 +88,7 @@ func (console *BuildConsole) Flush() {
 	if console.buffer.Len() == 0 {
 		return
 	}
-	LogDebug("ConsoleLog: \n%v", console.buffer.String())
+	console.logger.Debug.Printf("ConsoleLog: \n%v", console.buffer.String())
 
 	req := http.Request{
 		Method:        http.MethodPut,
@@ -97,7 +99,7 @@ func (console *BuildConsole) Flush() {
 	}
 	_, err := console.HttpClient.Do(&req)
 	if err != nil {
-		logger.Error.Printf("build console flush failed: %v", err)
+		console.logger.Error.Printf("build console flush failed: %v", err)
 	}
 	console.buffer.Reset()
 }
@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -31,6 +32,8 @@ import (
 const (
 	DefaultSecretMask           = "********"
 	DefaultCancelCommandTimeout = 25 * time.Second
+	DefaultKillGracePeriod      = 10 * time.Second
+	LastStepStatusEnv           = "GO_LAST_STEP_STATUS"
 )
 
 var (
@@ -46,12 +49,18 @@ func Executors() map[string]Executor {
 		protocol.CommandExport:              CommandExport,
 		protocol.CommandEcho:                CommandEcho,
 		protocol.CommandSecret:              CommandSecret,
+		protocol.CommandSecretFile:          CommandSecretFile,
+		protocol.CommandCapture:             CommandCapture,
 		protocol.CommandReportCurrentStatus: CommandReport,
 		protocol.CommandReportCompleting:    CommandReport,
 		protocol.CommandCompose:             CommandCompose,
+		protocol.CommandParallel:            CommandParallel,
+		protocol.CommandRetry:               CommandRetry,
+		protocol.CommandForeach:             CommandForeach,
 		protocol.CommandCond:                CommandCond,
 		protocol.CommandAnd:                 CommandAnd,
 		protocol.CommandOr:                  CommandOr,
+		protocol.CommandNot:                 CommandNot,
 		protocol.CommandTest:                CommandTest,
 		protocol.CommandExec:                CommandExec,
 		protocol.CommandMkdirs:              CommandMkdirs,
@@ -61,25 +70,35 @@ func Executors() map[string]Executor {
 		protocol.CommandDownloadDir:         CommandDownloadArtifact,
 		protocol.CommandFail:                CommandFail,
 		protocol.CommandGenerateTestReport:  CommandGenerateTestReport,
-		protocol.CommandGenerateProperty:    NotImplemented,
+		protocol.CommandGenerateProperty:    CommandGenerateProperty,
 	}
 }
 
 type BuildSession struct {
+	agent                 *Agent
 	send                  chan *protocol.Message
 	console               io.WriteCloser
 	artifacts             *Artifacts
+	properties            *Properties
 	command               *protocol.BuildCommand
 	artifactUploadBaseURL *url.URL
 
 	envs    map[string]string
+	secure  map[string]bool
+	unset   map[string]bool
 	cancel  chan bool
 	done    chan bool
-	echo    *stream.SubstituteWriter
-	secrets *stream.SubstituteWriter
+	secrets *stream.MaskWriter
+	stdout  io.Writer
+
+	builtins map[string]interface{}
+
+	secretFiles *secretFiles
 
 	buildId     string
 	buildStatus string
+	// quiet keeps command errors out of the console, the caller reports them
+	quiet bool
 
 	rootDir string
 	wd      string
@@ -87,30 +106,36 @@ type BuildSession struct {
 	executors map[string]Executor
 }
 
-func MakeBuildSession(buildId string,
+func MakeBuildSession(agent *Agent,
+	buildId string,
 	command *protocol.BuildCommand,
 	console io.WriteCloser,
 	artifacts *Artifacts,
+	properties *Properties,
 	artifactUploadBaseURL *url.URL,
 	send chan *protocol.Message,
 	rootDir string) *BuildSession {
 
-	secrets := stream.NewSubstituteWriter(console)
 	return &BuildSession{
+		agent:                 agent,
 		buildId:               buildId,
 		buildStatus:           protocol.BuildPassed,
 		console:               console,
 		artifacts:             artifacts,
+		properties:            properties,
 		artifactUploadBaseURL: artifactUploadBaseURL,
 		command:               command,
 		send:                  send,
 		envs:                  make(map[string]string),
+		secure:                make(map[string]bool),
+		unset:                 make(map[string]bool),
 		cancel:                make(chan bool),
 		done:                  make(chan bool),
-		secrets:               secrets,
-		echo:                  stream.NewSubstituteWriter(secrets),
+		secrets:               stream.NewMaskWriter(console),
+		builtins:              make(map[string]interface{}),
 		rootDir:               rootDir,
 		executors:             Executors(),
+		secretFiles:           &secretFiles{dir: agent.config.SecretFilesDir, buildId: buildId},
 	}
 }
 
@@ -132,11 +157,12 @@ func (s *BuildSession) isCanceled() bool {
 
 func (s *BuildSession) Run() error {
 	defer func() {
+		s.secretFiles.remove(s.agent.logger)
 		s.console.Close()
 		s.send <- protocol.CompletedMessage(s.Report(""))
-		LogInfo("Build completed")
+		s.infoLog("Build completed")
 	}()
-	LogInfo("Build started, root directory: %v", s.rootDir)
+	s.infoLog("Build started, root directory: %v", s.rootDir)
 	return s.ProcessCommand()
 }
 
@@ -166,21 +192,46 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 		return nil
 	}
 
-	err = s.doProcess(cmd)
+	buildStatus := s.buildStatus
+	if cmd.Timeout != "" {
+		err = s.doProcessWithTimeout(cmd)
+	} else {
+		err = s.doProcess(cmd)
+	}
+	s.secrets.Flush()
 	if s.isCanceled() {
-		LogInfo("build canceled")
+		s.infoLog("build canceled")
 		s.buildStatus = protocol.BuildCanceled
+	} else if cmd.AllowFailure {
+		s.allowFailure(cmd, err)
+		s.buildStatus = buildStatus
+		err = nil
 	} else if err != nil && s.buildStatus != protocol.BuildFailed {
 		s.buildStatus = protocol.BuildFailed
-		errMsg := Sprintf("ERROR: %v\n", err)
-		LogInfo(errMsg)
-		s.ConsoleLog(errMsg)
+		s.infoLog("ERROR: %v", err)
+		if !s.quiet {
+			s.ConsoleLog("ERROR: %v\n", err)
+		}
 	}
 
 	return
 }
 
+// allowFailure reports err of cmd as a warning and exports status of cmd
+// as LastStepStatusEnv for later commands.
+func (s *BuildSession) allowFailure(cmd *protocol.BuildCommand, err error) {
+	status := "passed"
+	if err != nil {
+		status = "failed"
+		s.warn("%v failed, continue because failure is allowed: %v", cmd.Name, err)
+	}
+	s.envs[LastStepStatusEnv] = status
+	delete(s.secure, LastStepStatusEnv)
+	delete(s.unset, LastStepStatusEnv)
+}
+
 func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
+	cmd = s.interpolateCommand(cmd)
 	s.wd = filepath.Clean(filepath.Join(s.rootDir, cmd.WorkingDirectory))
 	s.debugLog("set wd to %v", s.wd)
 
@@ -204,6 +255,52 @@ func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
 	}
 }
 
+// doProcessWithTimeout processes cmd in a sub session which is canceled,
+// OnCancel handlers included, when cmd does not finish in time.
+func (s *BuildSession) doProcessWithTimeout(cmd *protocol.BuildCommand) error {
+	timeout, err := time.ParseDuration(cmd.Timeout)
+	if err != nil {
+		return Err("Invalid timeout %v of %v: %v", cmd.Timeout, cmd.Name, err)
+	}
+	session := s.fork(cmd, make(chan bool))
+	session.buildStatus = s.buildStatus
+	// the sub session may still be running when we give up waiting for it
+	session.copyVars()
+	result := make(chan error, 1)
+	go func() {
+		defer close(session.done)
+		result <- session.doProcess(cmd)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-result:
+	case <-s.cancel:
+		session.Close()
+		select {
+		case err = <-result:
+		default:
+			return nil
+		}
+	case <-timer.C:
+		s.debugLog("%v timed out after %v", cmd.Name, timeout)
+		session.Close()
+		session.onCancel(cmd)
+		if !cmd.AllowFailure {
+			s.buildStatus = protocol.BuildFailed
+			s.infoLog("ERROR: %v timed out after %v", cmd.Name, timeout)
+			s.ConsoleLog("ERROR: %v timed out after %v\n", cmd.Name, timeout)
+		}
+		return Err("%v timed out after %v", cmd.Name, timeout)
+	}
+	s.setVars(session)
+	if session.buildStatus == protocol.BuildFailed {
+		s.buildStatus = protocol.BuildFailed
+	}
+	return err
+}
+
 func (s *BuildSession) testFailed(test *protocol.BuildCommand) bool {
 	if test == nil {
 		return false
@@ -227,22 +324,7 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 	if cmd.OnCancel == nil || !s.isCanceled() {
 		return
 	}
-	cancel := &BuildSession{
-		buildId:               s.buildId,
-		console:               s.console,
-		artifacts:             s.artifacts,
-		artifactUploadBaseURL: s.artifactUploadBaseURL,
-		send:        s.send,
-		envs:        s.envs,
-		secrets:     s.secrets,
-		echo:        s.echo,
-		rootDir:     s.rootDir,
-		executors:   s.executors,
-		command:     cmd.OnCancel,
-		buildStatus: protocol.BuildPassed,
-		cancel:      make(chan bool),
-		done:        make(chan bool),
-	}
+	cancel := s.fork(cmd.OnCancel, make(chan bool))
 	go func() {
 		cancel.ProcessCommand()
 	}()
@@ -256,30 +338,68 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 
 func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buffer, error) {
 	var output bytes.Buffer
-	session := &BuildSession{
-		buildId:               s.buildId,
-		artifacts:             s.artifacts,
-		artifactUploadBaseURL: s.artifactUploadBaseURL,
-		send:        s.send,
-		envs:        s.envs,
-		secrets:     s.secrets.Filter(&output),
-		echo:        s.echo.Filter(&output),
-		rootDir:     s.rootDir,
-		executors:   s.executors,
-		console:     stream.NopCloser(&output),
-		command:     cmd,
-		buildStatus: protocol.BuildPassed,
-		cancel:      s.cancel,
-		done:        make(chan bool),
-	}
+	session := s.fork(cmd, s.cancel)
+	session.secrets = s.secrets.Filter(&output)
+	session.stdout = nil
+	session.console = stream.NopCloser(&output)
 
 	err := session.ProcessCommand()
 	return output, err
 }
 
+// fork makes a session sharing console, envs and secrets with s to process
+// command, it is canceled by closing cancel.
+func (s *BuildSession) fork(command *protocol.BuildCommand, cancel chan bool) *BuildSession {
+	session := *s
+	session.command = command
+	session.buildStatus = protocol.BuildPassed
+	session.cancel = cancel
+	session.done = make(chan bool)
+	return &session
+}
+
+// copyVars gives the session its own copy of the environment variables,
+// so that changing them does not affect the session it was forked from.
+func (s *BuildSession) copyVars() {
+	envs := make(map[string]string, len(s.envs))
+	for k, v := range s.envs {
+		envs[k] = v
+	}
+	s.envs = envs
+	s.secure = copyFlags(s.secure)
+	s.unset = copyFlags(s.unset)
+}
+
+// setVars replaces the environment variables with the ones of session.
+func (s *BuildSession) setVars(session *BuildSession) {
+	for k := range s.envs {
+		delete(s.envs, k)
+	}
+	for k, v := range session.envs {
+		s.envs[k] = v
+	}
+	setFlags(s.secure, session.secure)
+	setFlags(s.unset, session.unset)
+}
+
+func copyFlags(flags map[string]bool) map[string]bool {
+	ret := make(map[string]bool, len(flags))
+	setFlags(ret, flags)
+	return ret
+}
+
+func setFlags(dest, src map[string]bool) {
+	for k := range dest {
+		delete(dest, k)
+	}
+	for k, v := range src {
+		dest[k] = v
+	}
+}
+
 func (s *BuildSession) Report(jobState string) *protocol.Report {
 	return &protocol.Report{
-		AgentRuntimeInfo: GetAgentRuntimeInfo(),
+		AgentRuntimeInfo: s.agent.RuntimeInfo(),
 		BuildId:          s.buildId,
 		JobState:         jobState,
 		Result:           s.buildStatus,
@@ -287,27 +407,67 @@ func (s *BuildSession) Report(jobState string) *protocol.Report {
 }
 
 func (s *BuildSession) ConsoleLog(format string, a ...interface{}) {
-	s.console.Write([]byte(Sprintf(format, a...)))
+	s.secrets.Write([]byte(Sprintf(format, a...)))
 }
 
-func (s *BuildSession) ReplaceEcho(name string, value interface{}) {
-	s.echo.Substitutions[name] = value
+// AddBuiltin adds variable ${name} for interpolation of command args,
+// value is a string or a func() string.
+func (s *BuildSession) AddBuiltin(name string, value interface{}) {
+	s.builtins[name] = value
 }
 
 func (s *BuildSession) Env() []string {
 	osEnv := os.Environ()
 	bsEnv := make([]string, 0, len(s.envs)+len(osEnv))
-	bsEnv = append(bsEnv, osEnv...)
+	for _, kv := range osEnv {
+		if !s.unset[strings.SplitN(kv, "=", 2)[0]] {
+			bsEnv = append(bsEnv, kv)
+		}
+	}
 	for key, value := range s.envs {
 		bsEnv = append(bsEnv, Sprintf("%v=%v", key, value))
 	}
 	return bsEnv
 }
 
+// Getenv returns value of environment variable name as seen by commands
+// of the build.
+func (s *BuildSession) Getenv(name string) string {
+	if value, ok := s.envs[name]; ok {
+		return value
+	}
+	if s.unset[name] {
+		return ""
+	}
+	return os.Getenv(name)
+}
+
+// envLog describes environment variables exported by the build for debug
+// log, values of secure ones are masked.
+func (s *BuildSession) envLog() string {
+	names := make([]string, 0, len(s.envs))
+	for name := range s.envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		value := s.envs[name]
+		if s.secure[name] {
+			value = DefaultSecretMask
+		}
+		names[i] = Sprintf("%v=%v", name, value)
+	}
+	return strings.Join(names, " ")
+}
+
 func (s *BuildSession) warn(format string, a ...interface{}) {
 	s.ConsoleLog(Sprintf("WARN: %v\n", format), a...)
 }
 
+func (s *BuildSession) infoLog(format string, a ...interface{}) {
+	s.agent.logger.Info.Printf(format, a...)
+}
+
 func (s *BuildSession) debugLog(format string, a ...interface{}) {
-	LogDebug(Sprintf("%v\n", format), a...)
+	s.agent.logger.Debug.Printf(Sprintf("%v\n", format), a...)
 }
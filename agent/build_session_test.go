@@ -22,6 +22,7 @@ import (
 	"github.com/xli/assert"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -92,6 +93,31 @@ exec command should have this
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestExportSecureValueIsMasked(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("DB_PASSWORD", "p@ss w/rd", "true"),
+		protocol.ExecCommand("sh", "-c", "echo $DB_PASSWORD; printf %s \"$DB_PASSWORD\" | base64"),
+		protocol.ExecCommand("echo", url.QueryEscape("p@ss w/rd"), url.PathEscape("p@ss w/rd")),
+		protocol.FailCommand("bad password p@ss w/rd"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'DB_PASSWORD' to value '********'
+********
+********
+******** ********
+ERROR: bad password ********
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
 func TestExecCommand(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -206,6 +232,25 @@ func TestShouldMaskSecretInExecOutput(t *testing.T) {
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestShouldMaskSecretSplitAcrossExecOutputWrites(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretCommand("thisissecret", "$$$$$$"),
+		protocol.ExecCommand("sh", "-c", "printf 'hello (this'; sleep 0.05; printf 'issec'; sleep 0.05; echo 'ret)'"),
+		protocol.ExecCommand("sh", "-c", "printf 'thisis'; exit 1"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("hello ($$$$$$)\nthisisERROR: exit status 1\n")
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
 func TestReplaceAgentBuildVairables(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -360,6 +405,50 @@ func TestTestCommand(t *testing.T) {
 	}
 }
 
+func TestExtendedTestCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("TEST_EXTENDED_TEST", "agent")
+	defer os.Unsetenv("TEST_EXTENDED_TEST")
+
+	wd := createTestProjectInPipelineDir()
+	now := time.Now()
+	os.Chtimes(filepath.Join(wd, "src/1.txt"), now, now.Add(-time.Hour))
+	test := func(args ...string) *protocol.BuildCommand {
+		return protocol.TestCommand(args...).Setwd(relativePath(wd))
+	}
+	right := func(cmd *protocol.BuildCommand, value string) *protocol.BuildCommand {
+		return cmd.AddArg("right", value)
+	}
+	check := func(test *protocol.BuildCommand) *protocol.BuildCommand {
+		return protocol.CondCommand(test, echo("yes"), echo("no"))
+	}
+
+	verify(t, []TestRow{
+		{check(test("-match", `^v\d+\.\d+$`, "echo", "v1.2")), "yes\n", "Passed"},
+		{check(test("-match", `^v\d+$`, "echo", "v1.2")), "no\n", "Passed"},
+		{check(test("-nmatch", `^v\d+$`, "echo", "v1.2")), "yes\n", "Passed"},
+		{check(test("-exit", "3", "sh", "-c", "exit 3")), "yes\n", "Passed"},
+		{check(test("-exit", "0", "sh", "-c", "exit 3")), "no\n", "Passed"},
+		{check(test("-exit", "0", "true")), "yes\n", "Passed"},
+		{check(right(test("-grep", "src/hello/3.txt"), "created for")), "yes\n", "Passed"},
+		{check(right(test("-grep", "src/hello/3.txt"), "^created")), "no\n", "Passed"},
+		{check(right(test("-grep", "src/missing.txt"), "created")), "no\n", "Passed"},
+		{check(test("-env", "TEST_EXTENDED_TEST")), "yes\n", "Passed"},
+		{check(test("-env", "TEST_EXTENDED_TEST_UNDEFINED")), "no\n", "Passed"},
+		{check(right(test("-enveq", "TEST_EXTENDED_TEST"), "agent")), "yes\n", "Passed"},
+		{check(right(test("-enveq", "TEST_EXTENDED_TEST"), "other")), "no\n", "Passed"},
+		{check(right(test("-lt", "9"), "10")), "yes\n", "Passed"},
+		{check(right(test("-lt", "10"), "9")), "no\n", "Passed"},
+		{check(right(test("-gt", "2.5"), "-1")), "yes\n", "Passed"},
+		{check(right(test("-gt", "x"), "1")), "no\n", "Passed"},
+		{check(right(test("-newer", "src/2.txt"), "src/1.txt")), "yes\n", "Passed"},
+		{check(right(test("-newer", "src/1.txt"), "src/2.txt")), "no\n", "Passed"},
+		{check(test("-glob", "**/world/*.txt")), "yes\n", "Passed"},
+		{check(test("-glob", "**/*.xml")), "no\n", "Passed"},
+	})
+}
+
 func TestTestCommandEchoShouldAlsoBeMaskedForSecrets(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -522,6 +611,21 @@ func TestOrCommand(t *testing.T) {
 		{or(falsy, falsy, falsy), "ERROR: \n", "Failed"}})
 }
 
+func TestNotCommand(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	truthy := protocol.ComposeCommand()
+	falsy := protocol.FailCommand("")
+	not := protocol.NotCommand
+
+	verify(t, []TestRow{
+		{not(falsy), "", "Passed"},
+		{not(truthy), "ERROR: expected compose to fail\n", "Failed"},
+		{not(not(truthy)), "", "Passed"},
+		{protocol.CondCommand(not(protocol.OrCommand(falsy, falsy)), echo("neither")), "neither\n", "Passed"},
+	})
+}
+
 type TestRow struct {
 	command  *protocol.BuildCommand
 	expected string
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"regexp"
+	"strings"
+)
+
+// CommandCapture exports trimmed standard output of its sub command, i.e.
+// what exec and echo commands in it print, as environment variable "name". With "regex" the first capture group, or
+// the whole match when there is no group, is exported instead; "secure"
+// masks the value like export does.
+func CommandCapture(s *BuildSession, cmd *protocol.BuildCommand) error {
+	if len(cmd.SubCommands) != 1 {
+		return Err("Expected a command to capture output, but got %v sub commands", len(cmd.SubCommands))
+	}
+	name := cmd.Args["name"]
+	if name == "" {
+		return Err("Missing name of environment variable to capture output")
+	}
+	var regex *regexp.Regexp
+	if expr := cmd.Args["regex"]; expr != "" {
+		var err error
+		if regex, err = regexp.Compile(expr); err != nil {
+			return Err("Invalid regex %v: %v", expr, err)
+		}
+	}
+
+	var output bytes.Buffer
+	command := cmd.SubCommands[0]
+	session := s.fork(command, s.cancel)
+	session.buildStatus = s.buildStatus
+	session.stdout = &output
+	if err := session.process(command); err != nil || s.isCanceled() {
+		if s.isCanceled() {
+			return nil
+		}
+		return Err("Can not capture output of %v", command.Name)
+	}
+
+	value := strings.TrimSpace(output.String())
+	if regex != nil {
+		match := regex.FindStringSubmatch(value)
+		if match == nil {
+			return Err("Output of %v does not match %v", command.Name, regex)
+		}
+		value = match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+	}
+	s.setEnv(name, value, cmd.Args["secure"] == "true")
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestCaptureCommandOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.CaptureCommand("VERSION", protocol.ExecCommand("sh", "-c", "echo '  1.2.3  '; echo 'warning: on stderr' >&2")),
+		protocol.CaptureCommand("MAJOR", protocol.ExecCommand("echo", "version 4.5.6")).AddArg("regex", `(\d+)\.\d+`),
+		protocol.CaptureCommand("BUILD", protocol.ExecCommand("echo", "build-789 done")).AddArg("regex", `build-\d+`),
+		protocol.CaptureCommand("TOKEN", protocol.ExecCommand("echo", "t0k3n")).AddArg("secure", "true"),
+		protocol.ExecCommand("sh", "-c", "echo $VERSION $MAJOR $BUILD $TOKEN"),
+		protocol.ExecCommand("echo", "${env:VERSION}").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `warning: on stderr
+setting environment variable 'VERSION' to value '1.2.3'
+setting environment variable 'MAJOR' to value '4'
+setting environment variable 'BUILD' to value 'build-789'
+setting environment variable 'TOKEN' to value '********'
+1.2.3 4 build-789 ********
+1.2.3
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestCaptureEchoOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.CaptureCommand("GREETING", protocol.ComposeCommand(
+			protocol.EchoCommand("hello"),
+			protocol.ExportCommand("NAME", "world", "false"),
+			protocol.ExecCommand("sh", "-c", "echo $NAME"),
+		)),
+		protocol.ExecCommand("sh", "-c", "echo captured: $GREETING"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'NAME' to value 'world'
+setting environment variable 'GREETING' to value 'hello
+world'
+captured: hello world
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestCaptureFailsWhenCommandFails(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.CaptureCommand("VERSION", protocol.ExecCommand("sh", "-c", "echo 1.2.3; exit 1")),
+		protocol.ExecCommand("sh", "-c", "echo ${VERSION-not captured}").RunIf("any"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `ERROR: exit status 1
+ERROR: Can not capture output of exec
+not captured
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestCaptureFailsWhenOutputDoesNotMatchRegex(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.CaptureCommand("VERSION", protocol.ExecCommand("echo", "unknown")).AddArg("regex", `\d+\.\d+`),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: Output of exec does not match \\d+\\.\\d+\n", trimTimestamp(log))
+}
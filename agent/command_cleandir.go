@@ -34,7 +34,7 @@ func CommandCleandir(s *BuildSession, cmd *protocol.BuildCommand) (err error) {
 	}
 	fullPath := filepath.Join(s.wd, path)
 	s.debugLog("cleandir %v, excludes: %+v", fullPath, allows)
-	return Cleandir(s.console, fullPath, allows...)
+	return Cleandir(s.secrets, fullPath, allows...)
 }
 
 func Cleandir(log io.Writer, root string, allows ...string) error {
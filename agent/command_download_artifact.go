@@ -18,21 +18,28 @@ package agent
 
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"net/url"
 	"path/filepath"
+	"strings"
 )
 
 func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error {
-	checksumURL, err := config.MakeFullServerURL(cmd.Args["checksumUrl"])
+	checksumURL, err := s.agent.config.MakeFullServerURL(cmd.Args["checksumUrl"])
 	if err != nil {
 		return err
 	}
 	absChecksumFile := filepath.Join(s.wd, cmd.Args["checksumFile"])
-	err = s.artifacts.DownloadFile(checksumURL, absChecksumFile)
+	err = s.artifacts.DownloadFile(checksumURL, absChecksumFile, nil, s.cancel)
+	if err != nil {
+		return err
+	}
+	checksums, err := s.downloadChecksums(checksumURL, absChecksumFile)
 	if err != nil {
 		return err
 	}
 
-	srcURL, err := config.MakeFullServerURL(cmd.Args["url"])
+	srcURL, err := s.agent.config.MakeFullServerURL(cmd.Args["url"])
 	if err != nil {
 		return err
 	}
@@ -42,19 +49,102 @@ func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error
 		_, fname := filepath.Split(srcPath)
 		absDestPath = filepath.Join(s.wd, cmd.Args["dest"], fname)
 	}
-	err = s.artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
-	if err == nil {
+	if s.verifyChecksum(srcPath, absDestPath, checksums) == nil {
 		s.ConsoleLog("[%v] exists and matches checksum, does not need dowload it from server.\n", srcPath)
 		return nil
 	}
+	dir := cmd.Name == protocol.CommandDownloadDir
+	if cache := s.agent.artifactCache(); cache != nil {
+		if key := ArtifactCacheKey(srcPath, dir, checksums); key != "" {
+			return s.downloadWithCache(cache, key, srcURL, srcPath, absDestPath, dir, checksums)
+		}
+	}
 	s.debugLog("download %v to %v", srcURL, absDestPath)
-	if cmd.Name == protocol.CommandDownloadDir {
-		err = s.artifacts.DownloadDir(srcURL, absDestPath)
+	if dir {
+		err = s.artifacts.DownloadDir(srcURL, absDestPath, s.ConsoleLog, s.cancel)
 	} else {
-		err = s.artifacts.DownloadFile(srcURL, absDestPath)
+		err = s.artifacts.DownloadFile(srcURL, absDestPath, s.ConsoleLog, s.cancel)
+	}
+	if err != nil {
+		return err
+	}
+	return s.verifyChecksum(srcPath, absDestPath, checksums)
+}
+
+func (s *BuildSession) downloadWithCache(cache *ArtifactCache, key string, srcURL *url.URL, srcPath, absDestPath string, dir bool, checksums Checksums) error {
+	hit, err := cache.Get(key, absDestPath, dir)
+	if err != nil {
+		return err
+	}
+	if hit {
+		if s.verifyChecksum(srcPath, absDestPath, checksums) == nil {
+			s.ConsoleLog("[%v] found in artifact cache.\n", srcPath)
+			return nil
+		}
+		s.warn("Artifact cache entry of %v does not match checksum, removing it", srcPath)
+		if err := cache.Remove(key); err != nil {
+			return err
+		}
 	}
+	s.ConsoleLog("[%v] not found in artifact cache, downloading from server.\n", srcPath)
+	s.debugLog("download %v to artifact cache %v", srcURL, key)
+	err = cache.Put(key, func(path string) error {
+		return s.artifacts.DownloadFile(srcURL, path, s.ConsoleLog, s.cancel)
+	})
 	if err != nil {
 		return err
 	}
-	return s.artifacts.VerifyChecksum(srcPath, absDestPath, absChecksumFile)
+	hit, err = cache.Get(key, absDestPath, dir)
+	if err != nil {
+		return err
+	}
+	if !hit {
+		// evicted by another agent sharing the cache
+		s.debugLog("artifact cache entry %v is gone, download %v to %v", key, srcURL, absDestPath)
+		if dir {
+			err = s.artifacts.DownloadDir(srcURL, absDestPath, s.ConsoleLog, s.cancel)
+		} else {
+			err = s.artifacts.DownloadFile(srcURL, absDestPath, s.ConsoleLog, s.cancel)
+		}
+		if err != nil {
+			return err
+		}
+		return s.verifyChecksum(srcPath, absDestPath, checksums)
+	}
+	if err := s.verifyChecksum(srcPath, absDestPath, checksums); err != nil {
+		cache.Remove(key)
+		return err
+	}
+	return nil
+}
+
+// downloadChecksums reads md5 checksums from checksumFile and downloads
+// stronger ones when the server has them.
+func (s *BuildSession) downloadChecksums(checksumURL *url.URL, checksumFile string) (Checksums, error) {
+	md5, err := ioutil.ReadFile(checksumFile)
+	if err != nil {
+		return nil, err
+	}
+	checksums := Checksums{"md5": ParseChecksum(string(md5))}
+	for _, algorithm := range ChecksumAlgorithms {
+		if algorithm == "md5" {
+			continue
+		}
+		sums, err := s.artifacts.FetchChecksums(AppendUrlParam(checksumURL, "checksum", algorithm), algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if sums != nil {
+			checksums[algorithm] = sums
+		}
+	}
+	return checksums, nil
+}
+
+func (s *BuildSession) verifyChecksum(srcPath, destPath string, checksums Checksums) error {
+	md5Only, err := s.artifacts.VerifyChecksum(srcPath, destPath, checksums, s.agent.config.RequireStrongChecksums)
+	if err == nil && len(md5Only) > 0 {
+		s.warn("Only md5 checksums are available to verify %v", strings.Join(md5Only, ", "))
+	}
+	return err
 }
@@ -21,8 +21,10 @@ import (
 )
 
 func CommandEcho(s *BuildSession, cmd *protocol.BuildCommand) error {
-	line := cmd.Args["line"]
-	s.echo.Write([]byte(line))
-	s.echo.Write([]byte{'\n'})
+	if s.stdout != nil {
+		_, err := s.stdout.Write([]byte(cmd.Args["line"] + "\n"))
+		return err
+	}
+	s.ConsoleLog("%v\n", cmd.Args["line"])
 	return nil
 }
@@ -19,21 +19,35 @@ package agent
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// CommandExec runs a process, besides 0 exit codes listed in
+// "acceptedExitCodes" are taken as success.
 func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
 	args, err := cmd.ListArg("args")
 	if err != nil {
 		return err
 	}
-	execCmd := exec.Command(cmd.Args["command"], args...)
+	accepted, err := acceptedExitCodes(cmd)
+	if err != nil {
+		return err
+	}
+	execCmd := exec.Command(s.lookPath(cmd.Args["command"]), args...)
 	execCmd.Env = s.Env()
+	s.debugLog("exec environment: %v", s.envLog())
 	execCmd.Stdout = s.secrets
+	if s.stdout != nil {
+		execCmd.Stdout = s.stdout
+	}
 	execCmd.Stderr = s.secrets
 	execCmd.Dir = s.wd
 	execCmd.Stdin = strings.NewReader(cmd.ExecInput)
-	done := make(chan error)
+	setProcessGroup(execCmd)
+	done := make(chan error, 1)
 	if err := execCmd.Start(); err != nil {
 		return err
 	}
@@ -44,14 +58,82 @@ func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
 	select {
 	case <-s.cancel:
 		s.debugLog("received cancel signal")
-		LogInfo("kill process(%v) %v", execCmd.Process, cmd.Args)
-		if err := execCmd.Process.Kill(); err != nil {
-			LogInfo("Kill command %v failed, error: %v\n", cmd.Args, err)
-		} else {
-			LogInfo("process %v is killed", execCmd.Process)
-		}
+		s.infoLog("kill process(%v) %v", execCmd.Process, cmd.Args)
+		s.killProcessGroup(execCmd.Process.Pid)
 		return Err("%v is canceled", cmd.Args)
 	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); ok && accepted[exitErr.ExitCode()] {
+			s.debugLog("exit code %v of %v is accepted", exitErr.ExitCode(), cmd.Args["command"])
+			return nil
+		}
 		return err
 	}
 }
+
+func acceptedExitCodes(cmd *protocol.BuildCommand) (map[int]bool, error) {
+	accepted := make(map[int]bool)
+	if _, ok := cmd.Args["acceptedExitCodes"]; !ok {
+		return accepted, nil
+	}
+	codes, err := cmd.ListArg("acceptedExitCodes")
+	if err != nil {
+		return nil, Err("Invalid acceptedExitCodes %v: %v", cmd.Args["acceptedExitCodes"], err)
+	}
+	for _, code := range codes {
+		c, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, Err("Invalid accepted exit code: %v", code)
+		}
+		accepted[c] = true
+	}
+	return accepted, nil
+}
+
+// lookPath finds command in PATH exported by the build, it is left to
+// exec.Command to look up in the agent process PATH when not found.
+func (s *BuildSession) lookPath(command string) string {
+	path, ok := s.envs["PATH"]
+	if !ok || strings.ContainsAny(command, `/\`) {
+		return command
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(s.wd, dir)
+		}
+		if file, err := exec.LookPath(filepath.Join(dir, command)); err == nil {
+			s.debugLog("found %v in exported PATH: %v", command, file)
+			return file
+		}
+	}
+	return command
+}
+
+// killProcessGroup terminates the process with all its children, those
+// still running after KillGracePeriod are killed.
+func (s *BuildSession) killProcessGroup(pid int) {
+	s.ConsoleLog("Terminating processes: %v\n", joinPids(processGroup(pid)))
+	if err := terminateProcessGroup(pid); err != nil {
+		s.infoLog("terminate process group %v failed: %v", pid, err)
+	}
+	grace := time.After(s.agent.config.KillGracePeriod)
+	for {
+		pids := processGroup(pid)
+		if len(pids) == 0 {
+			s.infoLog("process group %v is terminated", pid)
+			return
+		}
+		select {
+		case <-grace:
+			s.ConsoleLog("Killing processes still running after %v: %v\n", s.agent.config.KillGracePeriod, joinPids(pids))
+			if err := killProcessGroup(pid); err != nil {
+				s.infoLog("kill process group %v failed: %v", pid, err)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func joinPids(pids []int) string {
+	return strings.Trim(Sprintf("%v", pids), "[]")
+}
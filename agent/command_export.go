@@ -17,28 +17,122 @@
 package agent
 
 import (
+	"bufio"
+	"encoding/base64"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func CommandExport(s *BuildSession, cmd *protocol.BuildCommand) error {
-	msg := "setting environment variable '%v' to value '%v'\n"
 	name := cmd.Args["name"]
-	value, ok := cmd.Args["value"]
-	if !ok {
-		s.ConsoleLog(msg, name, os.Getenv(name))
-		return nil
+	switch op := cmd.Args["op"]; op {
+	case "", "set":
+		value, ok := cmd.Args["value"]
+		if !ok {
+			s.ConsoleLog("setting environment variable '%v' to value '%v'\n", name, os.Getenv(name))
+			return nil
+		}
+		s.setEnv(name, value, cmd.Args["secure"] == "true")
+	case "unset":
+		delete(s.envs, name)
+		delete(s.secure, name)
+		s.unset[name] = true
+		s.ConsoleLog("unsetting environment variable '%v'\n", name)
+	case "prepend", "append":
+		value := cmd.Args["value"]
+		if current := s.Getenv(name); current != "" {
+			if op == "prepend" {
+				value = value + string(filepath.ListSeparator) + current
+			} else {
+				value = current + string(filepath.ListSeparator) + value
+			}
+		}
+		s.envs[name] = value
+		delete(s.unset, name)
+		s.ConsoleLog("%v '%v' to environment variable '%v'\n", op+"ing", cmd.Args["value"], name)
+	case "load":
+		return s.loadEnv(filepath.Join(s.wd, cmd.Args["file"]), cmd.Args["secure"] == "true")
+	default:
+		return Err("Unknown export op: %v", op)
 	}
-	secure := cmd.Args["secure"]
+	return nil
+}
+
+func (s *BuildSession) setEnv(name, value string, secure bool) {
+	msg := "setting environment variable '%v' to value '%v'\n"
 	displayValue := value
-	if secure == "true" {
+	if secure {
 		displayValue = DefaultSecretMask
+		for _, secret := range secretEncodings(value) {
+			s.secrets.Add(secret, DefaultSecretMask)
+		}
 	}
 	_, override := s.envs[name]
-	if override || os.Getenv(name) != "" {
+	if override || s.Getenv(name) != "" {
 		msg = "overriding environment variable '%v' with value '%v'\n"
 	}
 	s.envs[name] = value
+	s.secure[name] = secure
+	delete(s.unset, name)
 	s.ConsoleLog(msg, name, displayValue)
-	return nil
+}
+
+// loadEnv exports variables of a dotenv or properties file: NAME=value or
+// NAME: value per line, split at the first = or :, optionally prefixed by
+// export, values may be quoted, lines starting with # or ! are comments.
+func (s *BuildSession) loadEnv(file string, secure bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.ConsoleLog("loading environment variables from '%v'\n", file)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i < 0 {
+			return Err("Invalid line %v in %v: %v", n, file, line)
+		}
+		name := strings.TrimSpace(strings.TrimPrefix(line[:i], "export "))
+		value, err := unquote(strings.TrimSpace(line[i+1:]))
+		if name == "" || err != nil {
+			return Err("Invalid line %v in %v: %v", n, file, line)
+		}
+		s.setEnv(name, value, secure)
+	}
+	return scanner.Err()
+}
+
+func unquote(value string) (string, error) {
+	if len(value) < 2 {
+		return value, nil
+	}
+	switch {
+	case value[0] == '"' && value[len(value)-1] == '"':
+		return strconv.Unquote(value)
+	case value[0] == '\'' && value[len(value)-1] == '\'':
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
+
+// secretEncodings returns value with its common encodings, so that they
+// are masked too when scripts print the value encoded.
+func secretEncodings(value string) []string {
+	return []string{
+		value,
+		base64.StdEncoding.EncodeToString([]byte(value)),
+		base64.RawStdEncoding.EncodeToString([]byte(value)),
+		base64.URLEncoding.EncodeToString([]byte(value)),
+		url.QueryEscape(value),
+		url.PathEscape(value),
+	}
 }
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnsetEnvironmentVariable(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("TEST_UNSET", "agent value")
+	defer os.Unsetenv("TEST_UNSET")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("EXPORTED", "value", "false"),
+		protocol.UnsetCommand("EXPORTED"),
+		protocol.UnsetCommand("TEST_UNSET"),
+		protocol.ExecCommand("sh", "-c", "echo ${EXPORTED-unset} ${TEST_UNSET-unset}"),
+		protocol.ExportCommand("TEST_UNSET", "again", "false"),
+		protocol.ExecCommand("sh", "-c", "echo $TEST_UNSET"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'EXPORTED' to value 'value'
+unsetting environment variable 'EXPORTED'
+unsetting environment variable 'TEST_UNSET'
+unset unset
+setting environment variable 'TEST_UNSET' to value 'again'
+again
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestPrependAndAppendPathList(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("TEST_PATH_LIST", "/agent")
+	defer os.Unsetenv("TEST_PATH_LIST")
+	sep := string(filepath.ListSeparator)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.PrependPathCommand("TEST_PATH_LIST", "/first"),
+		protocol.AppendPathCommand("TEST_PATH_LIST", "/last"),
+		protocol.AppendPathCommand("TEST_NEW_PATH_LIST", "/only"),
+		protocol.ExecCommand("sh", "-c", "echo $TEST_PATH_LIST; echo $TEST_NEW_PATH_LIST"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`prepending '/first' to environment variable 'TEST_PATH_LIST'
+appending '/last' to environment variable 'TEST_PATH_LIST'
+appending '/only' to environment variable 'TEST_NEW_PATH_LIST'
+/first%v/agent%v/last
+/only
+`, sep, sep)
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestLoadEnvironmentVariablesFromFile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", `printf '# detected versions\nexport NODE_VERSION=18.2.0\n\nJAVA_HOME = "/opt/java 17"\nQUOTED='"'"'a "b"'"'"'\n' > versions.env`).Setwd(relativePath(wd)),
+		protocol.LoadEnvCommand("versions.env", "false").Setwd(relativePath(wd)),
+		protocol.ExecCommand("sh", "-c", `echo "$NODE_VERSION|$JAVA_HOME|$QUOTED"`),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`loading environment variables from '%v'
+setting environment variable 'NODE_VERSION' to value '18.2.0'
+setting environment variable 'JAVA_HOME' to value '/opt/java 17'
+setting environment variable 'QUOTED' to value 'a "b"'
+18.2.0|/opt/java 17|a "b"
+`, filepath.Join(wd, "versions.env"))
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestLoadSecureEnvironmentVariablesFromFile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	err := writeFile(wd, "secrets.properties", "! credentials\ndb.password: s3cr3t\n")
+	assert.Nil(t, err)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.LoadEnvCommand("secrets.properties", "true").Setwd(relativePath(wd)),
+		protocol.ExecCommand("echo", "password is s3cr3t"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`loading environment variables from '%v'
+setting environment variable 'db.password' to value '********'
+password is ********
+`, filepath.Join(wd, "secrets.properties"))
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestLoadEnvironmentVariablesSplitsLinesAtFirstSeparator(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	err := writeFile(wd, "app.properties", "jdbc.options: a=b\nserver.url=http://localhost:8153\n")
+	assert.Nil(t, err)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.LoadEnvCommand("app.properties", "false").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`loading environment variables from '%v'
+setting environment variable 'jdbc.options' to value 'a=b'
+setting environment variable 'server.url' to value 'http://localhost:8153'
+`, filepath.Join(wd, "app.properties"))
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestLoadEnvironmentVariablesFromInvalidFile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	err := writeFile(wd, "invalid.env", "NAME=value\nnot a variable\n")
+	assert.Nil(t, err)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.LoadEnvCommand("invalid.env", "false").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	file := filepath.Join(wd, "invalid.env")
+	expected := Sprintf(`loading environment variables from '%v'
+setting environment variable 'NAME' to value 'value'
+ERROR: Invalid line 2 in %v: not a variable
+`, file, file)
+	assert.Equal(t, expected, trimTimestamp(log))
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"github.com/bmatcuk/doublestar"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CommandForeach processes its sub commands for each item of the "items"
+// list argument, each non empty line of "file" or each file matching
+// "glob" in the working directory, with the item exported as environment
+// variable "name". Items are processed one by one, or at most
+// "maxParallel" at the same time like CommandParallel does. It stops at
+// the first failed item unless "runAll" is true.
+func CommandForeach(s *BuildSession, cmd *protocol.BuildCommand) error {
+	name := cmd.Args["name"]
+	if name == "" {
+		return Err("Missing name of environment variable to bind foreach item")
+	}
+	items, err := foreachItems(s, cmd)
+	if err != nil {
+		return err
+	}
+	limit := 1
+	if arg := cmd.Args["maxParallel"]; arg != "" {
+		limit, err = strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return Err("Invalid maxParallel: %v", arg)
+		}
+	}
+	runAll := cmd.Args["runAll"] == "true"
+	s.debugLog("foreach %v in %v", name, items)
+
+	// sub commands decide themselves whether they run after a failure
+	body := protocol.ComposeCommand(cmd.SubCommands...).RunIf(protocol.RunIfConfigAny)
+	var failed []string
+	if limit > 1 {
+		commands := make([]*protocol.BuildCommand, len(items))
+		for i := range commands {
+			commands[i] = body
+		}
+		failed = s.processParallel(commands, items, limit, !runAll, func(i int, branch *BuildSession) {
+			branch.envs[name] = items[i]
+			delete(branch.secure, name)
+			delete(branch.unset, name)
+		})
+	} else {
+		value, exported := s.envs[name]
+		secure, isSecure := s.secure[name]
+		unset, isUnset := s.unset[name]
+		defer func() {
+			if exported {
+				s.envs[name] = value
+			} else {
+				delete(s.envs, name)
+			}
+			if isSecure {
+				s.secure[name] = secure
+			} else {
+				delete(s.secure, name)
+			}
+			if isUnset {
+				s.unset[name] = unset
+			} else {
+				delete(s.unset, name)
+			}
+		}()
+		delete(s.unset, name)
+		delete(s.secure, name)
+		for _, item := range items {
+			s.envs[name] = item
+			session := s.fork(body, s.cancel)
+			session.buildStatus = s.buildStatus
+			err := session.process(body)
+			if s.isCanceled() {
+				return nil
+			}
+			if err != nil {
+				failed = append(failed, item)
+				if !runAll {
+					break
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return Err("Foreach failed for: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func foreachItems(s *BuildSession, cmd *protocol.BuildCommand) ([]string, error) {
+	if _, ok := cmd.Args["items"]; ok {
+		return cmd.ListArg("items")
+	}
+	if file := cmd.Args["file"]; file != "" {
+		return readLines(filepath.Join(s.wd, file))
+	}
+	if pattern := cmd.Args["glob"]; pattern != "" {
+		matches, err := doublestar.Glob(filepath.Join(s.wd, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for i, match := range matches {
+			if matches[i], err = filepath.Rel(s.wd, match); err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(matches)
+		return matches, nil
+	}
+	return nil, Err("Expected items, file or glob to iterate over")
+}
+
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
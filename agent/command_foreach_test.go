@@ -0,0 +1,189 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestForeachItems(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ForeachCommand("MODULE",
+			echo("building ${env:MODULE}"),
+			protocol.ExecCommand("sh", "-c", "echo $MODULE done"),
+		).AddListArg("items", []string{"api", "web"}),
+		protocol.ExecCommand("sh", "-c", "echo ${MODULE-unset}"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `building api
+api done
+building web
+web done
+unset
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestForeachRestoresUnsetVariable(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("FOREACH_MODULE", "from agent")
+	defer os.Unsetenv("FOREACH_MODULE")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UnsetCommand("FOREACH_MODULE"),
+		protocol.ForeachCommand("FOREACH_MODULE",
+			protocol.ExecCommand("sh", "-c", "echo $FOREACH_MODULE"),
+		).AddListArg("items", []string{"api"}),
+		protocol.ExecCommand("sh", "-c", "echo ${FOREACH_MODULE-unset}"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `unsetting environment variable 'FOREACH_MODULE'
+api
+unset
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestForeachLinesOfFileAndGlobMatches(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	err := writeFile(wd, "modules.txt", "src\n\n  test  \n")
+	assert.Nil(t, err)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ForeachCommand("DIR", echo("dir ${env:DIR}")).AddArg("file", "modules.txt").Setwd(relativePath(wd)),
+		protocol.ForeachCommand("FILE", echo("file ${env:FILE}")).AddArg("glob", "**/world/*.txt").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `dir src
+dir test
+file test/world/10.txt
+file test/world/11.txt
+file test/world/8.txt
+file test/world/9.txt
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestForeachStopsAtFirstFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ForeachCommand("N",
+			protocol.ExecCommand("sh", "-c", "echo $N; test $N != 2"),
+		).AddListArg("items", []string{"1", "2", "3"}),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "1\n2\nERROR: exit status 1\nERROR: Foreach failed for: 2\n", trimTimestamp(log))
+}
+
+func TestForeachRunAll(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ForeachCommand("N",
+			protocol.ExecCommand("sh", "-c", "echo $N; test $N != 2"),
+		).AddListArg("items", []string{"1", "2", "3"}).AddArg("runAll", "true"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "1\n2\nERROR: exit status 1\n3\nERROR: Foreach failed for: 2\n", trimTimestamp(log))
+}
+
+func TestForeachWithMaxParallel(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ForeachCommand("N",
+			protocol.ExecCommand("sh", "-c", "sleep 0.1; echo item $N"),
+		).AddListArg("items", []string{"a", "b", "c", "d"}).AddArg("maxParallel", "2").AddArg("runAll", "true"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(strings.TrimSpace(trimTimestamp(log)), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, "[a] item a\n[b] item b\n[c] item c\n[d] item d", strings.Join(lines, "\n"))
+}
+
+func TestForeachAfterFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.FailCommand("boom"),
+		protocol.ForeachCommand("N",
+			echo("cleanup ${env:N}").RunIf("any"),
+		).AddListArg("items", []string{"a", "b"}).RunIf("any"),
+		protocol.ForeachCommand("N",
+			echo("parallel cleanup ${env:N}").RunIf("failed"),
+		).AddListArg("items", []string{"c"}).AddArg("maxParallel", "2").RunIf("failed"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `ERROR: boom
+cleanup a
+cleanup b
+[c] parallel cleanup c
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/xpath"
+	"os"
+	"path/filepath"
+)
+
+// CommandGenerateProperty sets build property "name" to the value of
+// "xpath" in XML file "src". Like the Java agent, a missing file or an
+// xpath that matches nothing is reported on console without failing the
+// build.
+func CommandGenerateProperty(s *BuildSession, cmd *protocol.BuildCommand) error {
+	name := cmd.Args["name"]
+	xpathArg := cmd.Args["xpath"]
+	file := filepath.Join(s.wd, cmd.Args["src"])
+
+	expr, err := xpath.Compile(xpathArg)
+	if err != nil {
+		s.ConsoleLog("Failed to create property %v. Illegal xpath: \"%v\", %v\n", name, xpathArg, err)
+		return nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		s.ConsoleLog("Failed to create property %v. File %v does not exist.\n", name, file)
+		return nil
+	} else if err != nil {
+		s.ConsoleLog("Failed to create property %v. %v\n", name, err)
+		return nil
+	}
+	defer f.Close()
+	value, matched, err := expr.Evaluate(f)
+	if err != nil {
+		s.ConsoleLog("Failed to create property %v. Can not evaluate xpath \"%v\" in the file %v: %v\n", name, xpathArg, file, err)
+		return nil
+	}
+	if !matched {
+		s.ConsoleLog("Failed to create property %v. Nothing matched xpath \"%v\" in the file: %v.\n", name, xpathArg, file)
+		return nil
+	}
+
+	err = s.properties.Set(name, value)
+	if err != nil {
+		return err
+	}
+	s.ConsoleLog("Property %v = %v created.\n", name, value)
+	return nil
+}
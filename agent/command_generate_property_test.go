@@ -0,0 +1,93 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"path/filepath"
+	"testing"
+)
+
+const versionReport = `<?xml version="1.0"?>
+<report>
+  <version>1.2.3</version>
+  <coverage type="line, %" value="65%  (325/500)"/>
+</report>`
+
+func TestGenerateProperty(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(wd, "report.xml", versionReport))
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GeneratePropertyCommand("version", "report.xml", "/report/version").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("line coverage", "report.xml", "substring-before(//coverage/@value, '%')").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("failures", "report.xml", "count(//failure)").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "Property version = 1.2.3 created.\nProperty line coverage = 65 created.\nProperty failures = 0 created.\n", trimTimestamp(log))
+
+	value, err := goServer.Property(buildId, "version")
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3", value)
+	value, err = goServer.Property(buildId, "line coverage")
+	assert.Nil(t, err)
+	assert.Equal(t, "65", value)
+	value, err = goServer.Property(buildId, "failures")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", value)
+}
+
+func TestGeneratePropertyReportsFailuresWithoutFailingBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(wd, "report.xml", versionReport))
+	assert.Nil(t, writeFile(wd, "broken.xml", "<report><version>"))
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.GeneratePropertyCommand("missing", "missing.xml", "/report/version").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("nothing", "report.xml", "/report/name").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("illegal", "report.xml", "/report[").Setwd(relativePath(wd)),
+		protocol.GeneratePropertyCommand("broken", "broken.xml", "/report/version").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`Failed to create property missing. File %v does not exist.
+Failed to create property nothing. Nothing matched xpath "/report/name" in the file: %v.
+Failed to create property illegal. Illegal xpath: "/report[", unexpected end of expression
+Failed to create property broken. Can not evaluate xpath "/report/version" in the file %v: XML syntax error on line 1: unexpected EOF
+`, filepath.Join(wd, "missing.xml"), filepath.Join(wd, "report.xml"), filepath.Join(wd, "broken.xml"))
+	assert.Equal(t, expected, trimTimestamp(log))
+
+	_, err = goServer.Property(buildId, "nothing")
+	assert.NotNil(t, err)
+}
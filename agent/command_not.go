@@ -0,0 +1,32 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+)
+
+func CommandNot(s *BuildSession, cmd *protocol.BuildCommand) error {
+	if len(cmd.SubCommands) != 1 {
+		return Err("Expected one command to negate, but got %v sub commands", len(cmd.SubCommands))
+	}
+	_, err := s.processTestCommand(cmd.SubCommands[0])
+	if err == nil {
+		return Err("expected %v to fail", cmd.SubCommands[0].Name)
+	}
+	return nil
+}
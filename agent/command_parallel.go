@@ -0,0 +1,153 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CommandParallel runs sub commands concurrently, each of them in its own
+// session with a copy of the environment variables. Output lines of a sub
+// command are prefixed with its name from the "names" list argument, or
+// its position. At most "maxParallel" sub commands run at the same time,
+// and with "failFast" the other sub commands are canceled once one fails.
+func CommandParallel(s *BuildSession, cmd *protocol.BuildCommand) error {
+	names, err := parallelNames(cmd)
+	if err != nil {
+		return err
+	}
+	limit := len(cmd.SubCommands)
+	if arg := cmd.Args["maxParallel"]; arg != "" {
+		limit, err = strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return Err("Invalid maxParallel: %v", arg)
+		}
+	}
+	failed := s.processParallel(cmd.SubCommands, names, limit, cmd.Args["failFast"] == "true", nil)
+	if len(failed) > 0 {
+		return Err("Parallel commands failed: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// processParallel processes commands concurrently as CommandParallel does
+// and returns names of the failed ones, prepare is called with each branch
+// session before it starts.
+func (s *BuildSession) processParallel(commands []*protocol.BuildCommand, names []string, limit int, failFast bool, prepare func(i int, branch *BuildSession)) []string {
+	cancel := make(chan bool)
+	var cancelOnce sync.Once
+	stop := func() {
+		cancelOnce.Do(func() { close(cancel) })
+	}
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-s.cancel:
+			stop()
+		case <-finished:
+		}
+	}()
+
+	console := &lockedWriter{writer: s.console}
+	slots := make(chan bool, limit)
+	branches := make([]*BuildSession, 0, len(commands))
+	errs := make([]error, len(commands))
+	var wg sync.WaitGroup
+	for i, sub := range commands {
+		select {
+		case slots <- true:
+		case <-cancel:
+		}
+		if isClosedChan(cancel) {
+			break
+		}
+		prefix := []byte(Sprintf("[%v] ", names[i]))
+		output := stream.NewLineWriter(console)
+		branch := s.fork(sub, cancel)
+		branch.buildStatus = s.buildStatus
+		branch.console = stream.NopCloser(stream.NewPrefixWriter(output, func() []byte { return prefix }))
+		branch.secrets = s.secrets.Filter(branch.console)
+		branch.copyVars()
+		if prepare != nil {
+			prepare(i, branch)
+		}
+		branches = append(branches, branch)
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				output.Flush()
+				<-slots
+				wg.Done()
+			}()
+			// the build may have failed before, only errors of the branch count
+			if err := branch.process(branch.command); err != nil && branch.buildStatus != protocol.BuildCanceled {
+				errs[i] = err
+			}
+			if failFast && errs[i] != nil {
+				stop()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if s.isCanceled() {
+		return nil
+	}
+	var failed []string
+	for i := range branches {
+		if errs[i] != nil {
+			failed = append(failed, names[i])
+		}
+	}
+	return failed
+}
+
+func parallelNames(cmd *protocol.BuildCommand) ([]string, error) {
+	if cmd.Args["names"] == "" {
+		names := make([]string, len(cmd.SubCommands))
+		for i := range names {
+			names[i] = strconv.Itoa(i + 1)
+		}
+		return names, nil
+	}
+	names, err := cmd.ListArg("names")
+	if err != nil {
+		return nil, err
+	}
+	if len(names) != len(cmd.SubCommands) {
+		return nil, Err("Expected %v names for parallel commands, but got %v", len(cmd.SubCommands), len(names))
+	}
+	return names, nil
+}
+
+type lockedWriter struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(out []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writer.Write(out)
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParallelWaitsForAllCommands(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sh", "-c", "echo hello; sleep 0.2; echo world"),
+			protocol.FailCommand("something is wrong"),
+		).AddListArg("names", []string{"slow", "fail"}),
+		echo("should not process this echo"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(trimTimestamp(log), "\n")
+	assert.Equal(t, []string{"[slow] hello", "[slow] world"}, linesWithPrefix(lines, "[slow] "))
+	assert.Equal(t, []string{"[fail] ERROR: something is wrong"}, linesWithPrefix(lines, "[fail] "))
+	assert.Equal(t, "ERROR: Parallel commands failed: fail", lines[len(lines)-2])
+	assert.Equal(t, 5, len(lines))
+}
+
+func TestParallelFailFastCancelsOtherCommands(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	started := time.Now()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sleep", "5").SetOnCancel(echo("sleep on cancel")),
+			protocol.ComposeCommand(
+				protocol.ExecCommand("sleep", "0.2"),
+				protocol.FailCommand("something is wrong"),
+			),
+		).AddArg("failFast", "true"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.True(t, time.Since(started) < 5*time.Second)
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(maskPids(trimTimestamp(log)), "\n")
+	assert.Equal(t, []string{"[1] Terminating processes: <pids>", "[1] sleep on cancel"}, linesWithPrefix(lines, "[1] "))
+	assert.Equal(t, []string{"[2] ERROR: something is wrong"}, linesWithPrefix(lines, "[2] "))
+	assert.Equal(t, "ERROR: Parallel commands failed: 2", lines[len(lines)-2])
+}
+
+func TestParallelWithMaxParallel(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sh", "-c", "sleep 0.2; echo first"),
+			echo("second"),
+			echo("third"),
+		).AddArg("maxParallel", "1"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "[1] first\n[2] second\n[3] third\n", trimTimestamp(log))
+}
+
+func TestParallelCommandsHaveTheirOwnEnvironment(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("SHARED", "shared", "false"),
+		protocol.SecretCommand("s3cr3t"),
+		protocol.ParallelCommand(
+			protocol.ComposeCommand(
+				protocol.ExportCommand("BRANCH", "one", "false"),
+				protocol.ExecCommand("sh", "-c", "echo $SHARED $BRANCH s3cr3t"),
+			),
+			protocol.ComposeCommand(
+				protocol.ExecCommand("sleep", "0.2"),
+				protocol.ExecCommand("sh", "-c", "echo $SHARED $BRANCH"),
+			),
+		),
+		protocol.ExecCommand("sh", "-c", "echo after: $BRANCH"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "[1] shared one ********\n"), log)
+	assert.True(t, contains(log, "[2] shared\n"), log)
+	assert.True(t, contains(log, "after:\n"), log)
+}
+
+func TestCancelParallelCommands(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ParallelCommand(
+			protocol.ExecCommand("sh", "-c", "touch started1; sleep 5").Setwd(relativePath(wd)),
+			protocol.ExecCommand("sh", "-c", "touch started2; sleep 5").Setwd(relativePath(wd)),
+		),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	waitForFile(filepath.Join(wd, "started1"))
+	waitForFile(filepath.Join(wd, "started2"))
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(maskPids(trimTimestamp(log)), "\n")
+	assert.Equal(t, []string{"[1] Terminating processes: <pids>"}, linesWithPrefix(lines, "[1] "))
+	assert.Equal(t, []string{"[2] Terminating processes: <pids>"}, linesWithPrefix(lines, "[2] "))
+	assert.Equal(t, 3, len(lines))
+}
+
+func linesWithPrefix(lines []string, prefix string) []string {
+	var ret []string
+	for _, l := range lines {
+		if strings.HasPrefix(l, prefix) {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
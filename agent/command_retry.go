@@ -0,0 +1,100 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// CommandRetry processes its first sub command up to "attempts" times
+// until it succeeds, sleeping "backoff" (default 1s) between attempts. With
+// "exponential" the backoff doubles after each attempt up to "maxBackoff",
+// with "jitter" a random backoff between half and all of it is used. The
+// optional second sub command is a test deciding whether a failure should
+// be retried.
+func CommandRetry(s *BuildSession, cmd *protocol.BuildCommand) error {
+	if len(cmd.SubCommands) == 0 || len(cmd.SubCommands) > 2 {
+		return Err("Expected a command and an optional retryable test, but got %v sub commands", len(cmd.SubCommands))
+	}
+	attempts, err := strconv.Atoi(cmd.Args["attempts"])
+	if err != nil || attempts < 1 {
+		return Err("Invalid attempts: %v", cmd.Args["attempts"])
+	}
+	backoff, err := durationArg(cmd, "backoff", time.Second)
+	if err != nil {
+		return err
+	}
+	maxBackoff, err := durationArg(cmd, "maxBackoff", 0)
+	if err != nil {
+		return err
+	}
+
+	command := cmd.SubCommands[0]
+	for attempt := 1; ; attempt++ {
+		session := s.fork(command, s.cancel)
+		session.buildStatus = s.buildStatus
+		session.quiet = true
+		err := session.process(command)
+		if s.isCanceled() || err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			return Err("%v failed after %v attempts: %v", command.Name, attempts, err)
+		}
+		if len(cmd.SubCommands) == 2 {
+			if _, testErr := s.processTestCommand(cmd.SubCommands[1]); testErr != nil {
+				if s.isCanceled() {
+					return nil
+				}
+				s.ConsoleLog("Attempt %v of %v failed and is not retryable\n", attempt, attempts)
+				return Err("%v failed: %v", command.Name, err)
+			}
+		}
+
+		sleep := backoff
+		if cmd.Args["jitter"] == "true" {
+			sleep = sleep/2 + time.Duration(rand.Int63n(int64(sleep/2)+1))
+		}
+		s.ConsoleLog("Attempt %v of %v failed: %v, retry in %v\n", attempt, attempts, err, sleep)
+		select {
+		case <-s.cancel:
+			return nil
+		case <-time.After(sleep):
+		}
+		if cmd.Args["exponential"] == "true" {
+			backoff *= 2
+			if maxBackoff > 0 && backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+func durationArg(cmd *protocol.BuildCommand, name string, defaultValue time.Duration) (time.Duration, error) {
+	arg := cmd.Args[name]
+	if arg == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, Err("Invalid %v: %v", name, arg)
+	}
+	return d, nil
+}
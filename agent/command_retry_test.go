@@ -0,0 +1,175 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryUntilCommandSucceeds(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand(3,
+			protocol.ExecCommand("sh", "-c", "echo x >> attempts; test $(wc -l < attempts) -eq 3").Setwd(relativePath(wd)),
+		).AddArg("backoff", "10ms"),
+		protocol.EchoCommand("done"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `Attempt 1 of 3 failed: exit status 1, retry in 10ms
+Attempt 2 of 3 failed: exit status 1, retry in 10ms
+done
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestRetryFailsAfterLastAttempt(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand(3, protocol.FailCommand("something is wrong")).
+			AddArg("backoff", "10ms").AddArg("exponential", "true"),
+		protocol.EchoCommand("should not process this echo"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `Attempt 1 of 3 failed: something is wrong, retry in 10ms
+Attempt 2 of 3 failed: something is wrong, retry in 20ms
+ERROR: fail failed after 3 attempts: something is wrong
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestRetryReportsNestedErrorOnce(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand(2,
+			protocol.ComposeCommand(
+				protocol.EchoCommand("attempt"),
+				protocol.FailCommand("something is wrong"),
+			),
+		).AddArg("backoff", "10ms"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `attempt
+Attempt 1 of 2 failed: something is wrong, retry in 10ms
+attempt
+ERROR: compose failed after 2 attempts: something is wrong
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestRetryOnlyRetryableFailures(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand(3,
+			protocol.ExecCommand("sh", "-c", "echo x >> attempts; test $(wc -l < attempts) -eq 2 && touch fatal; exit 1").Setwd(relativePath(wd)),
+			protocol.TestCommand("-nf", "fatal").Setwd(relativePath(wd)),
+		).AddArg("backoff", "10ms"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `Attempt 1 of 3 failed: exit status 1, retry in 10ms
+Attempt 2 of 3 failed and is not retryable
+ERROR: exec failed: exit status 1
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestRetryWithJitter(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand(2, protocol.FailCommand("something is wrong")).
+			AddArg("backoff", "20ms").AddArg("jitter", "true"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	lines := split(trimTimestamp(log), "\n")
+	prefix := "Attempt 1 of 2 failed: something is wrong, retry in "
+	assert.True(t, startWith(lines[0], prefix), lines[0])
+	sleep, err := time.ParseDuration(lines[0][len(prefix):])
+	assert.Nil(t, err)
+	assert.True(t, sleep >= 10*time.Millisecond && sleep <= 20*time.Millisecond, sleep)
+}
+
+func TestCancelInterruptsRetryBackoff(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.RetryCommand(3, protocol.FailCommand("something is wrong")).AddArg("backoff", "1m"),
+		protocol.EchoCommand("should not process this echo").RunIf("any"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	waitForConsoleLog("Attempt 1 of 3 failed: something is wrong, retry in 1m0s\n")
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func waitForConsoleLog(expected string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		log, _ := goServer.ConsoleLog(buildId)
+		if contains(trimTimestamp(log), expected) {
+			return
+		}
+		select {
+		case <-timeout:
+			panic("wait for console log timeout: " + expected)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
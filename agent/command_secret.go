@@ -27,6 +27,6 @@ func CommandSecret(s *BuildSession, cmd *protocol.BuildCommand) error {
 		substitution = DefaultSecretMask
 	}
 	s.debugLog("%v => %v", value, substitution)
-	s.secrets.Substitutions[value] = substitution
+	s.secrets.Add(value, substitution)
 	return nil
 }
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CommandSecretFile writes "value" to a file readable only by the agent
+// user and exports its path as environment variable "name". The file is
+// "path" in the working directory, which must not exist yet, or a new file
+// in a private directory of the build when path is empty. Its content is
+// masked in console output and the file is removed when the build ends.
+func CommandSecretFile(s *BuildSession, cmd *protocol.BuildCommand) error {
+	name := cmd.Args["name"]
+	value := cmd.Args["value"]
+	if name == "" {
+		return Err("Secret file requires an environment variable name")
+	}
+	for _, secret := range secretEncodings(value) {
+		s.secrets.Add(secret, DefaultSecretMask)
+	}
+
+	var file string
+	if path := cmd.Args["path"]; path != "" {
+		file = filepath.Join(s.wd, path)
+		if rel, err := filepath.Rel(s.rootDir, file); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return Err("Secret file %v is outside the agent sandbox.", file)
+		}
+	}
+	file, err := s.secretFiles.create(file)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, []byte(value), 0600)
+	if err != nil {
+		return err
+	}
+
+	s.envs[name] = file
+	s.secure[name] = false
+	s.ConsoleLog("setting environment variable '%v' to secret file '%v'\n", name, file)
+	return nil
+}
+
+// secretFiles are secret files written by a build. Their paths are saved
+// in a manifest before they are written, so files left behind by a build
+// interrupted by an agent crash are removed when the agent starts again.
+type secretFiles struct {
+	dir     string
+	buildId string
+	lock    sync.Mutex
+	files   []string
+}
+
+// create creates and records file, which must not exist yet as it is
+// removed when the build ends. An empty file is a new file in the private
+// directory of the build.
+func (f *secretFiles) create(file string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return "", err
+	}
+	if file == "" {
+		private := filepath.Join(f.dir, f.buildId)
+		if err := os.MkdirAll(private, 0700); err != nil {
+			return "", err
+		}
+		tmp, err := ioutil.TempFile(private, "secret")
+		if err != nil {
+			return "", err
+		}
+		file = tmp.Name()
+		tmp.Close()
+	} else {
+		created, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			return "", Err("Secret file %v already exists.", file)
+		} else if err != nil {
+			return "", err
+		}
+		created.Close()
+	}
+	manifest, err := os.OpenFile(f.manifest(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		os.Remove(file)
+		return "", err
+	}
+	_, err = manifest.WriteString(file + "\n")
+	if err1 := manifest.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(file)
+		return "", err
+	}
+	f.files = append(f.files, file)
+	return file, nil
+}
+
+func (f *secretFiles) remove(logger *Logger) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.files) == 0 {
+		return
+	}
+	removeSecretFilesOfBuild(f.manifest(), logger)
+	f.files = nil
+}
+
+func (f *secretFiles) manifest() string {
+	return filepath.Join(f.dir, f.buildId+".files")
+}
+
+// removeSecretFiles removes secret files and private directories of all
+// builds in dir
+func removeSecretFiles(dir string, logger *Logger) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error.Printf("failed to read %v: %v", dir, err)
+		}
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if strings.HasSuffix(info.Name(), ".files") {
+			logger.Info.Printf("remove secret files left behind in %v", path)
+			removeSecretFilesOfBuild(path, logger)
+		} else if info.IsDir() {
+			logger.Info.Printf("remove secret files left behind in %v", path)
+			if err := os.RemoveAll(path); err != nil {
+				logger.Error.Printf("failed to remove %v: %v", path, err)
+			}
+		}
+	}
+}
+
+func removeSecretFilesOfBuild(manifest string, logger *Logger) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		logger.Error.Printf("failed to read secret files: %v", err)
+		return
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		file := scanner.Text()
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logger.Error.Printf("failed to remove secret file %v: %v", file, err)
+		}
+	}
+	f.Close()
+	private := strings.TrimSuffix(manifest, ".files")
+	if err := os.RemoveAll(private); err != nil {
+		logger.Error.Printf("failed to remove %v: %v", private, err)
+	}
+	if err := os.Remove(manifest); err != nil {
+		logger.Error.Printf("failed to remove %v: %v", manifest, err)
+	}
+}
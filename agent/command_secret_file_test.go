@@ -0,0 +1,183 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var secretFilePath = regexp.MustCompile(`to secret file '([^']+)'`)
+
+func TestSecretFileInWorkingDir(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretFileCommand("NPMRC", "//registry/:_authToken=t0k3n", ".npmrc").Setwd(relativePath(wd)),
+		protocol.ExecCommand("sh", "-c", "ls -l $NPMRC | cut -c1-10; cat $NPMRC; echo").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	file := filepath.Join(wd, ".npmrc")
+	expected := Sprintf("setting environment variable 'NPMRC' to secret file '%v'\n-rw-------\n********\n", file)
+	assert.Equal(t, expected, trimTimestamp(log))
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestSecretFileInPrivateDir(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretFileCommand("KUBECONFIG", "apiVersion: v1\ntoken: t0k3n", ""),
+		protocol.ExecCommand("sh", "-c", "ls -ld $(dirname $KUBECONFIG) | cut -c1-10; cat $KUBECONFIG; echo"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	log = trimTimestamp(log)
+	file := secretFilePath.FindStringSubmatch(log)[1]
+	assert.True(t, strings.HasPrefix(file, GetConfig().SecretFilesDir), file)
+	assert.True(t, strings.HasSuffix(log, "\ndrwx------\n********\n"), log)
+	_, err = os.Stat(filepath.Dir(file))
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestSecretFileIsRemovedWhenBuildIsCanceled(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretFileCommand("CREDENTIALS", "t0k3n", "credentials.json").Setwd(relativePath(wd)),
+		protocol.ExecCommand("sleep", "5"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	file := filepath.Join(wd, "credentials.json")
+	waitForFile(file)
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestSecretFileOutsideSandbox(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretFileCommand("CREDENTIALS", "t0k3n", "../../../credentials"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), "/credentials is outside the agent sandbox.\n"), log)
+}
+
+func TestSecretFileInSiblingOfSandbox(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	sibling := GetConfig().WorkingDir + "-evil"
+	defer os.RemoveAll(sibling)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretFileCommand("CREDENTIALS", "t0k3n", "../"+filepath.Base(sibling)+"/credentials"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), "-evil/credentials is outside the agent sandbox.\n"), log)
+	_, err = os.Stat(filepath.Join(sibling, "credentials"))
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestSecretFileDoesNotReplaceExistingFile(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(wd, ".npmrc", "registry=https://registry"))
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.SecretFileCommand("NPMRC", "//registry/:_authToken=t0k3n", ".npmrc").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	file := filepath.Join(wd, ".npmrc")
+	assert.True(t, strings.HasSuffix(trimTimestamp(log), Sprintf("Secret file %v already exists.\n", file)), log)
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "registry=https://registry", string(content))
+}
+
+func TestRemoveSecretFilesLeftBehindWhenAgentStarts(t *testing.T) {
+	workingDir, err := ioutil.TempDir("", "gocd-golang-agent")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workingDir)
+	defaultWorkingDir := os.Getenv("GOCD_AGENT_WORKING_DIR")
+	os.Setenv("GOCD_AGENT_WORKING_DIR", workingDir)
+	config := LoadConfig()
+	os.Setenv("GOCD_AGENT_WORKING_DIR", defaultWorkingDir)
+
+	secretFile := filepath.Join(workingDir, "credentials")
+	privateFile := filepath.Join(config.SecretFilesDir, "build1", "secret123")
+	assert.Nil(t, writeFile(filepath.Dir(privateFile), filepath.Base(privateFile), "t0k3n"))
+	assert.Nil(t, writeFile(workingDir, "credentials", "t0k3n"))
+	assert.Nil(t, writeFile(config.SecretFilesDir, "build1.files", secretFile+"\n"+privateFile+"\n"))
+
+	_, err = New(config)
+	assert.Nil(t, err)
+
+	for _, file := range []string{secretFile, privateFile, filepath.Dir(privateFile), filepath.Join(config.SecretFilesDir, "build1.files")} {
+		_, err = os.Stat(file)
+		assert.True(t, os.IsNotExist(err), file)
+	}
+}
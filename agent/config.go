@@ -21,6 +21,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 	"crypto/tls"
@@ -29,6 +30,8 @@ import (
 type Config struct {
 	Hostname           string
 	SendMessageTimeout time.Duration
+	ShutdownTimeout    time.Duration
+	KillGracePeriod    time.Duration
 	ServerUrl          *url.URL
 	ServerHostAndPort  string
 	ContextPath        string
@@ -38,6 +41,8 @@ type Config struct {
 	WorkingDir         string
 	LogDir             string
 	ConfigDir          string
+	OutboxDir          string
+	SecretFilesDir     string
 	IpAddress          string
 
 	AgentAutoRegisterKey             string
@@ -52,6 +57,14 @@ type Config struct {
 	AgentIdFile         string
 	AgentTokenFile      string
 	OutputDebugLog      bool
+
+	ChecksumAlgorithms     []string
+	RequireStrongChecksums bool
+
+	ArtifactCacheDir       string
+	ArtifactCacheSize      int64
+	ArtifactCacheHardLinks bool
+	DownloadRetry          DownloadRetry
 }
 
 func LoadConfig() *Config {
@@ -69,14 +82,51 @@ func LoadConfig() *Config {
 	}
 	wd = filepath.Clean(wd)
 	configDir := filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"))
+	shutdownTimeout, err := time.ParseDuration(readEnv("GOCD_AGENT_SHUTDOWN_TIMEOUT", "5m"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_SHUTDOWN_TIMEOUT is invalid: %v", err))
+	}
+	killGracePeriod, err := time.ParseDuration(readEnv("GOCD_AGENT_KILL_GRACE_PERIOD", DefaultKillGracePeriod.String()))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_KILL_GRACE_PERIOD is invalid: %v", err))
+	}
+	checksumAlgorithms := []string{"sha256"}
+	if os.Getenv("GOCD_AGENT_SHA512_CHECKSUMS") == "true" {
+		checksumAlgorithms = append(checksumAlgorithms, "sha512")
+	}
+	artifactCacheDir := os.Getenv("GOCD_AGENT_ARTIFACT_CACHE_DIR")
+	if artifactCacheDir != "" && !filepath.IsAbs(artifactCacheDir) {
+		artifactCacheDir = filepath.Join(wd, artifactCacheDir)
+	}
+	artifactCacheSize, err := strconv.ParseInt(readEnv("GOCD_AGENT_ARTIFACT_CACHE_SIZE_MB", "10240"), 10, 64)
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_ARTIFACT_CACHE_SIZE_MB is invalid: %v", err))
+	}
+	downloadRetry := DefaultDownloadRetry
+	downloadRetry.Attempts, err = strconv.Atoi(readEnv("GOCD_AGENT_DOWNLOAD_ATTEMPTS", strconv.Itoa(downloadRetry.Attempts)))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_DOWNLOAD_ATTEMPTS is invalid: %v", err))
+	}
+	downloadRetry.Backoff, err = time.ParseDuration(readEnv("GOCD_AGENT_DOWNLOAD_BACKOFF", downloadRetry.Backoff.String()))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_DOWNLOAD_BACKOFF is invalid: %v", err))
+	}
+	downloadRetry.MaxBackoff, err = time.ParseDuration(readEnv("GOCD_AGENT_DOWNLOAD_MAX_BACKOFF", downloadRetry.MaxBackoff.String()))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_DOWNLOAD_MAX_BACKOFF is invalid: %v", err))
+	}
 	return &Config{
 		Hostname:                         hostname,
 		SendMessageTimeout:               120 * time.Second,
+		ShutdownTimeout:                  shutdownTimeout,
+		KillGracePeriod:                  killGracePeriod,
 		ServerUrl:                        serverUrl,
 		ServerHostAndPort:                serverUrl.Host,
 		WorkingDir:                       wd,
 		LogDir:                           os.Getenv("GOCD_AGENT_LOG_DIR"),
 		ConfigDir:                        configDir,
+		OutboxDir:                        filepath.Join(configDir, "outbox"),
+		SecretFilesDir:                   filepath.Join(configDir, "secret-files"),
 		GoServerCAFile:                   filepath.Join(configDir, "go-server-ca.pem"),
 		AgentPrivateKeyFile:              filepath.Join(configDir, "agent-private-key.pem"),
 		AgentCertFile:                    filepath.Join(configDir, "agent-cert.pem"),
@@ -92,6 +142,12 @@ func LoadConfig() *Config {
 		RegistrationPath:                 readEnv("GOCD_SERVER_REGISTRATION_PATH", "/admin/agent"),
 		TokenPath:                        readEnv( "GOCD_SERVER_TOKEN_PATH", "/admin/agent/token"),
 		IpAddress:                        lookupIpAddress(serverUrl.Host),
+		ChecksumAlgorithms:               checksumAlgorithms,
+		RequireStrongChecksums:           os.Getenv("GOCD_AGENT_REQUIRE_STRONG_CHECKSUMS") == "true",
+		ArtifactCacheDir:                 artifactCacheDir,
+		ArtifactCacheSize:                artifactCacheSize * 1024 * 1024,
+		ArtifactCacheHardLinks:           os.Getenv("GOCD_AGENT_ARTIFACT_CACHE_HARD_LINKS") == "true",
+		DownloadRetry:                    downloadRetry,
 	}
 }
 
@@ -150,7 +206,7 @@ func (c *Config) MakeFullServerURL(u string) (*url.URL, error) {
 }
 
 func (c *Config) IsElasticAgent() bool {
-	return config.AgentAutoRegisterElasticPluginId == ""
+	return c.AgentAutoRegisterElasticPluginId == ""
 }
 
 func readEnv(varname string, defaultVal string) string {
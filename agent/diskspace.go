@@ -23,17 +23,17 @@ import (
 	"syscall"
 )
 
-func UsableSpace() int64 {
+func (a *Agent) UsableSpace() int64 {
 	_, free, err := diskSpace("/")
 	if err != nil {
-		LogInfo("Unknown diskspace, error: %v", err)
+		a.logger.Info.Printf("Unknown diskspace, error: %v", err)
 		return -1
 	}
 	return free
 }
 
-func UsableSpaceString() string {
-	return strconv.FormatInt(UsableSpace(), 10)
+func (a *Agent) UsableSpaceString() string {
+	return strconv.FormatInt(a.UsableSpace(), 10)
 }
 
 // Space returns total and free bytes available in a directory, e.g. `/`.
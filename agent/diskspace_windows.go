@@ -25,22 +25,22 @@ import (
 	"os"
 )
 
-func UsableSpace() int64 {
+func (a *Agent) UsableSpace() int64 {
 	wd, err := os.Getwd()
 	if err != nil {
-		LogInfo("Cannot find working directory, error: %v", err)
+		a.logger.Info.Printf("Cannot find working directory, error: %v", err)
 		return -1
 	}
 	_, free, err := diskSpace(wd)
 	if err != nil {
-		LogInfo("Unknown diskspace, error: %v", err)
+		a.logger.Info.Printf("Unknown diskspace, error: %v", err)
 		return -1
 	}
 	return free
 }
 
-func UsableSpaceString() string {
-	return strconv.FormatInt(UsableSpace(), 10)
+func (a *Agent) UsableSpaceString() string {
+	return strconv.FormatInt(a.UsableSpace(), 10)
 }
 
 
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"strings"
+)
+
+// interpolateCommand returns a copy of cmd with variables in its args,
+// working directory and exec input substituted, sub commands are
+// interpolated when they are processed.
+func (s *BuildSession) interpolateCommand(cmd *protocol.BuildCommand) *protocol.BuildCommand {
+	c := *cmd
+	c.WorkingDirectory = s.interpolateArg(cmd.Name, "WorkingDirectory", cmd.WorkingDirectory)
+	c.ExecInput = s.interpolateArg(cmd.Name, "ExecInput", cmd.ExecInput)
+	if cmd.Args != nil {
+		c.Args = make(map[string]string, len(cmd.Args))
+		for name, value := range cmd.Args {
+			c.Args[name] = s.interpolateArg(cmd.Name, name, value)
+		}
+	}
+	return &c
+}
+
+func (s *BuildSession) interpolateArg(cmdName, name, value string) string {
+	if !strings.Contains(value, "${") {
+		return value
+	}
+	var list []string
+	if strings.HasPrefix(value, "[") && json.Unmarshal([]byte(value), &list) == nil {
+		for i, item := range list {
+			list[i] = s.interpolateArg(cmdName, Sprintf("%v[%v]", name, i), item)
+		}
+		bs, _ := json.Marshal(list)
+		return string(bs)
+	}
+	result := s.interpolate(value, false)
+	if result != value {
+		s.debugLog("interpolate %v %v: %v => %v", cmdName, name, value, s.interpolate(value, true))
+	}
+	return result
+}
+
+// interpolate substitutes ${env:NAME}, ${env:NAME:-default} and built-in
+// variables like ${agent.location} in str, $${ escapes a literal ${.
+// Unknown variables are kept as they are, so that shell scripts can still
+// use ${NAME}. Values of secure environment variables are masked when
+// masked is true.
+func (s *BuildSession) interpolate(str string, masked bool) string {
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(str, "${")
+		if i < 0 {
+			buf.WriteString(str)
+			return buf.String()
+		}
+		if i > 0 && str[i-1] == '$' {
+			buf.WriteString(str[:i-1])
+			buf.WriteString("${")
+			str = str[i+2:]
+			continue
+		}
+		end := strings.Index(str[i:], "}")
+		if end < 0 {
+			buf.WriteString(str)
+			return buf.String()
+		}
+		end += i
+		if value, ok := s.variable(str[i+2:end], masked); ok {
+			buf.WriteString(str[:i])
+			buf.WriteString(value)
+		} else {
+			buf.WriteString(str[:end+1])
+		}
+		str = str[end+1:]
+	}
+}
+
+func (s *BuildSession) variable(name string, masked bool) (string, bool) {
+	if strings.HasPrefix(name, "env:") {
+		name, def := name[len("env:"):], ""
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, def = name[:i], name[i+2:]
+		}
+		value := s.Getenv(name)
+		if value == "" {
+			return def, true
+		}
+		if masked && s.secure[name] {
+			return DefaultSecretMask, true
+		}
+		return value, true
+	}
+	switch value := s.builtins[name].(type) {
+	case string:
+		return value, true
+	case func() string:
+		return value(), true
+	}
+	return "", false
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolateExecArgs(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	os.Setenv("TEST_INTERPOLATE", "from agent")
+	defer os.Unsetenv("TEST_INTERPOLATE")
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("GREETING", "hello", "false"),
+		protocol.ExecCommand("echo", "${env:GREETING} ${env:TEST_INTERPOLATE}"),
+		protocol.ExecCommand("echo", "${env:UNDEFINED_VARIABLE:-default value}", "[${env:UNDEFINED_VARIABLE}]"),
+		protocol.ExecCommand("echo", "$${env:GREETING}", "${agent.hostname}"),
+		protocol.ExecCommand("sh", "-c", "echo ${GREETING} ${unknown:-shell}"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`setting environment variable 'GREETING' to value 'hello'
+hello from agent
+default value []
+${env:GREETING} %v
+hello shell
+`, GetConfig().Hostname)
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestInterpolateWorkingDirectoryAndExecInput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("PIPELINE_DIR", relativePath(wd), "false"),
+		protocol.ExportCommand("NAME", "world", "false"),
+		protocol.ExecCommand("pwd").Setwd("${env:PIPELINE_DIR}"),
+		protocol.ExecCommand("cat").SetExecInput("hello ${env:NAME}\n"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf(`setting environment variable 'PIPELINE_DIR' to value '%v'
+setting environment variable 'NAME' to value 'world'
+%v
+hello world
+`, relativePath(wd), wd)
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestInterpolateSecureValueIsMasked(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("TOKEN", "t0k3n", "true"),
+		protocol.ExecCommand("echo", "token=${env:TOKEN}"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "setting environment variable 'TOKEN' to value '********'\ntoken=********\n"
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestExecFindsCommandInExportedPath(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	bin := filepath.Join(wd, "bin")
+	err := writeFile(bin, "hello-interpolation", "#!/bin/sh\necho hello from $0\n")
+	assert.Nil(t, err)
+	err = os.Chmod(filepath.Join(bin, "hello-interpolation"), 0755)
+	assert.Nil(t, err)
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("PATH", bin+string(filepath.ListSeparator)+"${env:PATH}", "false"),
+		protocol.ExecCommand("hello-interpolation"),
+		protocol.ExecCommand("sh", "-c", "echo shell"),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("overriding environment variable 'PATH' with value '%v%v%v'\nhello from %v\nshell\n",
+		bin, string(filepath.ListSeparator), os.Getenv("PATH"), filepath.Join(bin, "hello-interpolation"))
+	assert.Equal(t, expected, trimTimestamp(log))
+}
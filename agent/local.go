@@ -0,0 +1,135 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// ReadBuildFile reads a protocol.Build, or a single protocol.BuildCommand,
+// from a JSON file. Commands without runIfConfig run when the build passed.
+func ReadBuildFile(file string) (*protocol.Build, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var build protocol.Build
+	if err := json.Unmarshal(data, &build); err != nil {
+		return nil, err
+	}
+	if build.BuildCommand == nil {
+		var cmd protocol.BuildCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return nil, err
+		}
+		if cmd.Name == "" {
+			return nil, Err("%v does not contain a build or a build command", file)
+		}
+		build.BuildCommand = &cmd
+	}
+	if build.BuildId == "" {
+		build.BuildId = "local"
+	}
+	defaultRunIf(build.BuildCommand)
+	return &build, nil
+}
+
+func defaultRunIf(cmd *protocol.BuildCommand) {
+	if cmd == nil {
+		return
+	}
+	if cmd.RunIfConfig == "" {
+		cmd.RunIfConfig = protocol.RunIfConfigPassed
+	}
+	for _, sub := range cmd.SubCommands {
+		defaultRunIf(sub)
+	}
+	defaultRunIf(cmd.Test)
+	defaultRunIf(cmd.OnCancel)
+}
+
+// RunLocal runs build in workingDir without Go server: the console log is
+// written to console, uploaded artifacts and test reports are saved in
+// outputDir. Canceling ctx cancels the build. It returns the build status.
+func RunLocal(ctx context.Context, build *protocol.Build, workingDir, outputDir string, console io.Writer, logger *Logger) (string, error) {
+	wd, err := filepath.Abs(workingDir)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(wd); err != nil {
+		return "", err
+	}
+	out, err := filepath.Abs(outputDir)
+	if err != nil {
+		return "", err
+	}
+	if err := Mkdirs(out); err != nil {
+		return "", err
+	}
+	secretFilesDir, err := ioutil.TempDir("", "gocd-secret-files")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(secretFilesDir)
+
+	hostname, _ := os.Hostname()
+	a := &Agent{
+		Id: "local",
+		config: &Config{
+			Hostname:        hostname,
+			WorkingDir:      wd,
+			ServerUrl:       &url.URL{},
+			KillGracePeriod: DefaultKillGracePeriod,
+			SecretFilesDir:  secretFilesDir,
+		},
+		logger: logger,
+		state:  map[string]string{"runtimeStatus": "Building"},
+	}
+	send := make(chan *protocol.Message)
+	defer close(send)
+	go func() {
+		for msg := range send {
+			logger.Debug.Printf("--> %v", msg.Action)
+		}
+	}()
+
+	session := a.makeBuildSession(build,
+		stream.NopCloser(stream.NewPrefixWriter(console, timestampPrefix)),
+		&Artifacts{logger: logger, localDir: out},
+		&Properties{logger: logger},
+		&url.URL{},
+		send,
+	)
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Info.Printf("cancel build: %v", ctx.Err())
+			session.Close()
+		case <-session.done:
+		}
+	}()
+	session.Run()
+	return session.buildStatus, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunBuildCommandFileLocally(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocd-golang-agent-local")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	wd := filepath.Join(dir, "wd")
+	createTestProject(wd)
+
+	file := filepath.Join(dir, "build.json")
+	err = ioutil.WriteFile(file, []byte(`{"name": "compose", "subCommands": [
+		{"name": "secret", "args": {"value": "s3cr3t"}},
+		{"name": "echo", "args": {"line": "password is s3cr3t"}},
+		{"name": "uploadArtifact", "args": {"src": "src/hello", "dest": "dest"}},
+		{"name": "fail", "args": {"message": "boom"}},
+		{"name": "echo", "args": {"line": "skipped"}},
+		{"name": "echo", "args": {"line": "always"}, "runIfConfig": "any"}
+	]}`), 0644)
+	assert.Nil(t, err)
+
+	build, err := ReadBuildFile(file)
+	assert.Nil(t, err)
+	var console bytes.Buffer
+	output := filepath.Join(dir, "output")
+	status, err := RunLocal(context.Background(), build, wd, output, &console, MakeLogger(dir, "local.log", true))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.BuildFailed, status)
+
+	expected := Sprintf("password is ********\nUploading artifacts from %v to dest\nERROR: boom\nalways\n", filepath.Join(wd, "src/hello"))
+	assert.Equal(t, expected, trimTimestamp(console.String()))
+	_, err = os.Stat(filepath.Join(output, "dest/hello/3.txt"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(output, "dest/hello/4.txt"))
+	assert.Nil(t, err)
+}
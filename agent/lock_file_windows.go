@@ -0,0 +1,51 @@
+// +build windows
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const lockfileExclusiveLock = 2
+
+// lockFile locks file path shared or exclusive between processes, it
+// blocks until the lock is acquired and returns the function releasing it.
+// Closing the file releases the lock.
+func lockFile(path string, exclusive bool) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var flags uintptr
+	if exclusive {
+		flags = lockfileExclusiveLock
+	}
+	h := syscall.MustLoadDLL("kernel32.dll")
+	c := h.MustFindProc("LockFileEx")
+	overlapped := syscall.Overlapped{}
+	// According to MSDN, r1 = 0 means the call failed
+	r1, _, errCall := c.Call(file.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r1 == 0 {
+		file.Close()
+		return nil, errCall
+	}
+	return func() { file.Close() }, nil
+}
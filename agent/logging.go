@@ -31,7 +31,7 @@ type Logger struct {
 }
 
 func MakeLogger(logDir, file string, debug bool) *Logger {
-	var output, debugOutput io.Writer
+	var output io.Writer
 	if logDir != "" {
 		fpath := filepath.Join(logDir, file)
 		var err error
@@ -42,7 +42,11 @@ func MakeLogger(logDir, file string, debug bool) *Logger {
 	} else {
 		output = os.Stdout
 	}
+	return MakeWriterLogger(output, debug)
+}
 
+func MakeWriterLogger(output io.Writer, debug bool) *Logger {
+	var debugOutput io.Writer
 	if debug {
 		debugOutput = output
 	} else {
@@ -19,6 +19,13 @@ import (
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -46,10 +53,11 @@ func TestOnCancel1(t *testing.T) {
 	assert.Nil(t, err)
 
 	expected := `echo before sleep
+Terminating processes: <pids>
 read on cancel
 compose on cancel
 `
-	assert.Equal(t, expected, trimTimestamp(log))
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
 }
 
 func TestOnCancel2(t *testing.T) {
@@ -75,9 +83,11 @@ func TestOnCancel2(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 
-	expected := `WARN: Kill cancel task because it did not finish in 10ms.
+	expected := `Terminating processes: <pids>
+WARN: Kill cancel task because it did not finish in 10ms.
+Terminating processes: <pids>
 `
-	assert.Equal(t, expected, trimTimestamp(log))
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
 }
 
 func TestOnCancelShouldContinueMaskEchos(t *testing.T) {
@@ -99,8 +109,29 @@ func TestOnCancelShouldContinueMaskEchos(t *testing.T) {
 	assert.Nil(t, err)
 
 	config := GetConfig()
-	expected := Sprintf("$$$ on cancel: %v\n", config.WorkingDir)
-	assert.Equal(t, expected, trimTimestamp(log))
+	expected := Sprintf("Terminating processes: <pids>\n$$$ on cancel: %v\n", config.WorkingDir)
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
+}
+
+func TestOnCancelShouldMaskSecureExports(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("TOKEN", "t0k3n", "true"),
+		protocol.ExecCommand("sleep", "5").SetOnCancel(protocol.ExecCommand("sh", "-c", "echo token on cancel: $TOKEN")),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := "setting environment variable 'TOKEN' to value '********'\nTerminating processes: <pids>\ntoken on cancel: ********\n"
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
 }
 
 func TestCancelBuildWhenBuildIsHangingOnTestCommand(t *testing.T) {
@@ -125,3 +156,104 @@ func TestCancelBuildWhenBuildIsHangingOnTestCommand(t *testing.T) {
 	expected := "hello before cancel\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
+
+func TestCancelTerminatesChildProcesses(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "sleep 30 & echo $! > child.pid; wait").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	child := waitForPidFile(filepath.Join(wd, "child.pid"))
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	pids := strings.Fields(strings.TrimPrefix(strings.TrimSpace(trimTimestamp(log)), "Terminating processes: "))
+	assert.Equal(t, 2, len(pids))
+	assert.True(t, contains(strings.Join(pids, " "), strconv.Itoa(child)))
+	assert.Equal(t, false, processIsRunning(child))
+}
+
+func TestCancelKillsProcessesIgnoringTerminateSignal(t *testing.T) {
+	config := GetConfig()
+	config.KillGracePeriod = 200 * time.Millisecond
+	defer func() {
+		config.KillGracePeriod = DefaultKillGracePeriod
+	}()
+
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "trap '' TERM; sleep 30 & echo $! > child.pid; wait").Setwd(relativePath(wd)),
+	)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	child := waitForPidFile(filepath.Join(wd, "child.pid"))
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `Terminating processes: <pids>
+Killing processes still running after 200ms: <pids>
+`
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
+	assert.True(t, contains(log, strconv.Itoa(child)))
+	assert.Equal(t, false, processIsRunning(child))
+}
+
+var pidList = regexp.MustCompile(`(?m)^((?:\[\S+\] )?(?:Terminating processes|Killing processes still running after \S+)): [\d ]+$`)
+
+func maskPids(log string) string {
+	return pidList.ReplaceAllString(log, "$1: <pids>")
+}
+
+func waitForPidFile(file string) int {
+	timeout := time.After(5 * time.Second)
+	for {
+		data, err := ioutil.ReadFile(file)
+		if err == nil && strings.HasSuffix(string(data), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				panic(err)
+			}
+			return pid
+		}
+		select {
+		case <-timeout:
+			panic("wait for pid file timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func processIsRunning(pid int) bool {
+	timeout := time.After(time.Second)
+	for {
+		// the killed process is reaped by init, which may take a moment
+		process, err := os.FindProcess(pid)
+		if err != nil || process.Signal(syscall.Signal(0)) != nil {
+			return false
+		}
+		data, err := ioutil.ReadFile(Sprintf("/proc/%v/stat", pid))
+		if err == nil && strings.Contains(string(data), ") Z ") {
+			return false
+		}
+		select {
+		case <-timeout:
+			return true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
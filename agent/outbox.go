@@ -0,0 +1,249 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outbox outlives websocket connections: build sessions keep sending to
+// it while the agent is reconnecting, and queued messages are forwarded
+// once a new connection is attached.
+//
+// Messages are sent one at a time. Build reports are kept until the server
+// acknowledges them and are resent on timeout or reconnect, completing and
+// completed reports are also saved in dir so that they survive an agent
+// restart. Other messages, e.g. ping, are best effort.
+type Outbox struct {
+	Send    chan *protocol.Message
+	attach  chan *WebsocketConnection
+	flush   chan chan bool
+	dir     string
+	timeout time.Duration
+	logger  *Logger
+
+	queue   []*protocol.Message
+	queued  map[string]bool
+	files   map[string]string
+	flushed []chan bool
+}
+
+func MakeOutbox(dir string, timeout time.Duration, logger *Logger) *Outbox {
+	outbox := &Outbox{
+		Send:    make(chan *protocol.Message),
+		attach:  make(chan *WebsocketConnection),
+		flush:   make(chan chan bool),
+		dir:     dir,
+		timeout: timeout,
+		logger:  logger,
+		queued:  make(map[string]bool),
+		files:   make(map[string]string),
+	}
+	go outbox.run()
+	return outbox
+}
+
+func (o *Outbox) Attach(conn *WebsocketConnection) {
+	o.attach <- conn
+}
+
+func (o *Outbox) Detach() {
+	o.attach <- nil
+}
+
+// Flush waits until all queued build reports are acknowledged, returns
+// false if they are not delivered in time.
+func (o *Outbox) Flush(timeout time.Duration) bool {
+	done := make(chan bool)
+	o.flush <- done
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (o *Outbox) run() {
+	var conn *WebsocketConnection
+	var inflight *protocol.Message
+	var timeout <-chan time.Time
+	for {
+		if len(o.flushed) > 0 && !o.hasReliableMessage() {
+			for _, done := range o.flushed {
+				close(done)
+			}
+			o.flushed = nil
+		}
+		if conn != nil && inflight == nil && len(o.queue) > 0 {
+			inflight = o.queue[0]
+			o.logger.Info.Printf("--> %v", inflight.Action)
+			if err := conn.Write(inflight); err != nil {
+				o.logger.Error.Printf("send message failed: %v", err)
+				if err := conn.Conn.Close(); err != nil {
+					o.logger.Error.Printf("Close websocket connection failed: %v", err)
+				}
+				conn, inflight = nil, nil
+				continue
+			}
+			timeout = time.After(o.timeout)
+		}
+
+		var acknowledge chan string
+		if conn != nil {
+			acknowledge = conn.Acknowledge
+		}
+		select {
+		case msg := <-o.Send:
+			if conn == nil && !isReliableMessage(msg) {
+				o.logger.Debug.Printf("websocket is disconnected, drop %v", msg.Action)
+			} else {
+				o.enqueue(msg)
+			}
+		case done := <-o.flush:
+			o.flushed = append(o.flushed, done)
+		case c := <-o.attach:
+			conn, inflight, timeout = c, nil, nil
+			if conn != nil {
+				o.restore()
+			}
+		case id := <-acknowledge:
+			if inflight != nil && id == inflight.AcknowledgeId {
+				o.dequeue()
+				inflight, timeout = nil, nil
+			} else {
+				o.logger.Info.Printf("ignore acknowledge with id: %v", id)
+			}
+		case <-timeout:
+			o.logger.Info.Printf("wait for message acknowledge timeout, id: %v", inflight.AcknowledgeId)
+			if isReliableMessage(inflight) {
+				o.logger.Info.Printf("resend %v, id: %v", inflight.Action, inflight.AcknowledgeId)
+			} else {
+				o.dequeue()
+			}
+			inflight, timeout = nil, nil
+		}
+	}
+}
+
+func (o *Outbox) enqueue(msg *protocol.Message) {
+	if o.queued[msg.AcknowledgeId] {
+		o.logger.Info.Printf("drop duplicated %v, id: %v", msg.Action, msg.AcknowledgeId)
+		return
+	}
+	if isPersistentMessage(msg) && o.files[msg.AcknowledgeId] == "" {
+		o.persist(msg)
+	}
+	o.queue = append(o.queue, msg)
+	o.queued[msg.AcknowledgeId] = true
+}
+
+func (o *Outbox) dequeue() {
+	msg := o.queue[0]
+	o.queue = o.queue[1:]
+	delete(o.queued, msg.AcknowledgeId)
+	if file := o.files[msg.AcknowledgeId]; file != "" {
+		if err := os.Remove(file); err != nil {
+			o.logger.Error.Printf("failed to remove %v: %v", file, err)
+		}
+		delete(o.files, msg.AcknowledgeId)
+	}
+}
+
+func (o *Outbox) persist(msg *protocol.Message) {
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = Mkdirs(o.dir)
+	}
+	file := filepath.Join(o.dir, Sprintf("%020d-%v.json", time.Now().UnixNano(), msg.AcknowledgeId))
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0600)
+	}
+	if err != nil {
+		o.logger.Error.Printf("failed to save %v to %v: %v", msg.Action, o.dir, err)
+		return
+	}
+	o.files[msg.AcknowledgeId] = file
+}
+
+// restore queues messages saved by a previous agent process
+func (o *Outbox) restore() {
+	infos, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			o.logger.Error.Printf("failed to read %v: %v", o.dir, err)
+		}
+		return
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := filepath.Join(o.dir, name)
+		var msg protocol.Message
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			o.logger.Error.Printf("ignore unreadable message %v: %v", file, err)
+			continue
+		}
+		if o.queued[msg.AcknowledgeId] {
+			if o.files[msg.AcknowledgeId] != file {
+				o.logger.Info.Printf("drop duplicated %v, id: %v", msg.Action, msg.AcknowledgeId)
+				os.Remove(file)
+			}
+			continue
+		}
+		o.logger.Info.Printf("restore %v, id: %v", msg.Action, msg.AcknowledgeId)
+		o.files[msg.AcknowledgeId] = file
+		o.enqueue(&msg)
+	}
+}
+
+func (o *Outbox) hasReliableMessage() bool {
+	for _, msg := range o.queue {
+		if isReliableMessage(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func isReliableMessage(msg *protocol.Message) bool {
+	switch msg.Action {
+	case protocol.ReportCurrentStatusAction, protocol.ReportCompletingAction, protocol.ReportCompletedAction:
+		return true
+	}
+	return false
+}
+
+func isPersistentMessage(msg *protocol.Message) bool {
+	return msg.Action == protocol.ReportCompletingAction || msg.Action == protocol.ReportCompletedAction
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedeliverSavedReportsWhenAgentStarts(t *testing.T) {
+	buildId = "TestRedeliverSavedReportsWhenAgentStarts"
+	stateLog.Reset(buildId, AgentId)
+
+	report := &protocol.Report{
+		AgentRuntimeInfo: GetAgentRuntimeInfo(),
+		BuildId:          buildId,
+		Result:           protocol.BuildPassed,
+	}
+	msg := protocol.CompletedMessage(report)
+	data, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	dir := GetConfig().OutboxDir
+	assert.Nil(t, Mkdirs(dir))
+	// the same message saved twice should only be delivered once
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "1-"+msg.AcknowledgeId+".json"), data, 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "2-"+msg.AcknowledgeId+".json"), data, 0600))
+
+	agentStopped = runAgent(t)
+	defer tearDown()
+
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	waitForEmptyOutbox(t, dir)
+}
+
+func TestResendReportUntilAcknowledged(t *testing.T) {
+	a, config, cleanup := startAnotherAgent(t, "TestResendReportUntilAcknowledged")
+	defer cleanup()
+	goServer.SetWithholdAcks(true)
+	defer goServer.SetWithholdAcks(false)
+
+	goServer.SendBuild(a.Id, buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	// resent after the acknowledge timeout
+	assert.Equal(t, "build Passed", stateLog.Next())
+	infos, err := ioutil.ReadDir(config.OutboxDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(infos))
+
+	goServer.SetWithholdAcks(false)
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	waitForEmptyOutbox(t, config.OutboxDir)
+}
+
+func waitForEmptyOutbox(t *testing.T, dir string) {
+	timeout := time.After(time.Second)
+	for {
+		infos, err := ioutil.ReadDir(dir)
+		assert.Nil(t, err)
+		if len(infos) == 0 {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("acknowledged report is not removed from %v", dir)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Properties sets build properties on Go server, without httpClient, e.g.
+// running build locally, properties are not sent anywhere.
+type Properties struct {
+	httpClient *http.Client
+	logger     *Logger
+	baseURL    *url.URL
+}
+
+func (p *Properties) Set(name, value string) error {
+	if p.httpClient == nil {
+		p.logger.Debug.Printf("no Go server, ignore property %v", name)
+		return nil
+	}
+	dest := *p.baseURL
+	dest.Path = strings.TrimSuffix(dest.Path, "/") + "/" + name
+	dest.RawPath = strings.TrimSuffix(p.baseURL.EscapedPath(), "/") + "/" + url.PathEscape(name)
+	p.logger.Debug.Printf("set property %v => %v", name, dest.String())
+	resp, err := p.httpClient.PostForm(dest.String(), url.Values{"value": {value}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	p.logger.Debug.Printf("response: %v", resp.Status)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Err("Failed to set property %v. Server response: %v", name, resp.Status)
+	}
+	return nil
+}
@@ -29,25 +29,25 @@ import (
 	"runtime"
 )
 
-func ReadGoServerCACert() error {
-	_, err := os.Stat(config.GoServerCAFile)
+func (a *Agent) ReadGoServerCACert() error {
+	_, err := os.Stat(a.config.GoServerCAFile)
 	if err == nil {
 		return nil
 	}
 
-	LogInfo("fetching Go server[%v] CA certificate", config.ServerHostAndPort)
-	conn, err := tls.Dial("tcp", config.ServerHostAndPort, &tls.Config{
+	a.logger.Info.Printf("fetching Go server[%v] CA certificate", a.config.ServerHostAndPort)
+	conn, err := tls.Dial("tcp", a.config.ServerHostAndPort, &tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
-		logger.Error.Printf("failed to connect: " + err.Error())
+		a.logger.Error.Printf("failed to connect: " + err.Error())
 		return err
 	}
 	defer conn.Close()
 	state := conn.ConnectionState()
-	certOut, err := os.Create(config.GoServerCAFile)
+	certOut, err := os.Create(a.config.GoServerCAFile)
 	if err != nil {
-		logger.Error.Printf("failed to open %v for writing: %s", config.GoServerCAFile, err)
+		a.logger.Error.Printf("failed to open %v for writing: %s", a.config.GoServerCAFile, err)
 		return err
 	}
 	defer certOut.Close()
@@ -57,8 +57,8 @@ func ReadGoServerCACert() error {
 	return nil
 }
 
-func GoServerRootCAs() (*x509.CertPool, error) {
-	caCert, err := ioutil.ReadFile(config.GoServerCAFile)
+func (a *Agent) GoServerRootCAs() (*x509.CertPool, error) {
+	caCert, err := ioutil.ReadFile(a.config.GoServerCAFile)
 	if err != nil {
 		return nil, err
 	}
@@ -70,20 +70,20 @@ func GoServerRootCAs() (*x509.CertPool, error) {
 	return roots, nil
 }
 
-func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
+func (a *Agent) GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	certs := make([]tls.Certificate, 0)
 	if withClientCert {
-		cert, err := tls.LoadX509KeyPair(config.AgentCertFile, config.AgentPrivateKeyFile)
+		cert, err := tls.LoadX509KeyPair(a.config.AgentCertFile, a.config.AgentPrivateKeyFile)
 		if err != nil {
 			return nil, err
 		}
 		certs = append(certs, cert)
 	}
-	roots, err := GoServerRootCAs()
+	roots, err := a.GoServerRootCAs()
 	if err != nil {
 		return nil, err
 	}
-	serverName, err := extractServerDN(config.GoServerCAFile)
+	serverName, err := extractServerDN(a.config.GoServerCAFile)
 	if err != nil {
 		return nil, err
 	}
@@ -94,8 +94,8 @@ func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	}, nil
 }
 
-func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
-	config, err := GoServerTlsConfig(withClientCert)
+func (a *Agent) GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
+	config, err := a.GoServerTlsConfig(withClientCert)
 	if err != nil {
 		return nil, err
 	}
@@ -105,23 +105,23 @@ func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
 	return &http.Client{Transport: tr}, nil
 }
 
-func Register() error {
-	if err := ReadGoServerCACert(); err != nil {
+func (a *Agent) Register() error {
+	if err := a.ReadGoServerCACert(); err != nil {
 		return err
 	}
-	if err := requestToken(); err != nil {
+	if err := a.requestToken(); err != nil {
 		return err
 	}
-	if err := readAgentKeyAndCerts(registerData()); err != nil {
+	if err := a.readAgentKeyAndCerts(a.registerData()); err != nil {
 		return err
 	}
 	return nil
 }
 
-func CleanRegistration() error {
-	files := []string{config.GoServerCAFile,
-		config.AgentPrivateKeyFile,
-		config.AgentCertFile}
+func (a *Agent) CleanRegistration() error {
+	files := []string{a.config.GoServerCAFile,
+		a.config.AgentPrivateKeyFile,
+		a.config.AgentCertFile}
 	for _, f := range files {
 		_, err := os.Stat(f)
 		if err == nil {
@@ -135,20 +135,20 @@ func CleanRegistration() error {
 }
 
 
-func requestToken() error {
-	_, agentTokenErr := os.Stat(config.AgentTokenFile)
+func (a *Agent) requestToken() error {
+	_, agentTokenErr := os.Stat(a.config.AgentTokenFile)
 	if agentTokenErr == nil {
 		return nil
 	}
 
-	client, err := GoServerRemoteClient(false)
+	client, err := a.GoServerRemoteClient(false)
 	if err != nil {
 		return err
 	}
 
-	url, err := config.TokenURL(AgentId)
+	url, err := a.config.TokenURL(a.Id)
 	if agentTokenErr != nil {
-		LogInfo( "fetching token from : %v", url.String())
+		a.logger.Info.Printf("fetching token from : %v", url.String())
 	}
 	resp, err := client.Get(url.String())
 
@@ -159,55 +159,55 @@ func requestToken() error {
 	if resp.StatusCode == http.StatusOK {
 		bodyBytes, err2 := ioutil.ReadAll(resp.Body)
 		if err2 == nil {
-			ioutil.WriteFile(config.AgentTokenFile, []byte(string(bodyBytes)), 0600)
+			ioutil.WriteFile(a.config.AgentTokenFile, []byte(string(bodyBytes)), 0600)
 		}else{
-			LogInfo("Token fetched but cannot read body")
+			a.logger.Info.Printf("Token fetched but cannot read body")
 			return err2
 		}
 	}else{
-		LogInfo("Cannot fetch token from : %v", url)
+		a.logger.Info.Printf("Cannot fetch token from : %v", url)
 		return err
 	}
 
 	return nil
 }
 
-func registerData() map[string]string {
+func (a *Agent) registerData() map[string]string {
 	return map[string]string{
-		"hostname":                      config.Hostname,
-		"uuid":                          AgentId,
-		"location":                      config.WorkingDir,
+		"hostname":                      a.config.Hostname,
+		"uuid":                          a.Id,
+		"location":                      a.config.WorkingDir,
 		"operatingSystem":               runtime.GOOS,
-		"usablespace":                   UsableSpaceString(),
-		"agentAutoRegisterKey":          config.AgentAutoRegisterKey,
-		"agentAutoRegisterResources":    config.AgentAutoRegisterResources,
-		"agentAutoRegisterEnvironments": config.AgentAutoRegisterEnvironments,
-		"agentAutoRegisterHostname":     config.Hostname,
-		"elasticAgentId":                config.AgentAutoRegisterElasticAgentId,
-		"elasticPluginId":               config.AgentAutoRegisterElasticPluginId,
+		"usablespace":                   a.UsableSpaceString(),
+		"agentAutoRegisterKey":          a.config.AgentAutoRegisterKey,
+		"agentAutoRegisterResources":    a.config.AgentAutoRegisterResources,
+		"agentAutoRegisterEnvironments": a.config.AgentAutoRegisterEnvironments,
+		"agentAutoRegisterHostname":     a.config.Hostname,
+		"elasticAgentId":                a.config.AgentAutoRegisterElasticAgentId,
+		"elasticPluginId":               a.config.AgentAutoRegisterElasticPluginId,
 		"supportsBuildCommandProtocol":  "true",
 	}
 }
 
-func readAgentKeyAndCerts(params map[string]string) error {
+func (a *Agent) readAgentKeyAndCerts(params map[string]string) error {
 	var token string
-	_, agentPrivateKeyFileErr := os.Stat(config.AgentPrivateKeyFile)
-	_, agentCertFileErr := os.Stat(config.AgentCertFile)
-	_, agentTokenFileErr := os.Stat(config.AgentTokenFile)
+	_, agentPrivateKeyFileErr := os.Stat(a.config.AgentPrivateKeyFile)
+	_, agentCertFileErr := os.Stat(a.config.AgentCertFile)
+	_, agentTokenFileErr := os.Stat(a.config.AgentTokenFile)
 	if agentPrivateKeyFileErr == nil && agentCertFileErr == nil && agentTokenFileErr == nil {
 		return nil
 	}
 
-	client, err := GoServerRemoteClient(false)
+	client, err := a.GoServerRemoteClient(false)
 	if err != nil {
 		return err
 	}
 
 
-	if _, err := os.Stat(config.AgentTokenFile); err == nil {
-		data, err2 := ioutil.ReadFile(config.AgentTokenFile)
+	if _, err := os.Stat(a.config.AgentTokenFile); err == nil {
+		data, err2 := ioutil.ReadFile(a.config.AgentTokenFile)
 		if err2 != nil {
-			logger.Error.Printf("failed to read token file(%v): %v", config.AgentTokenFile, err2)
+			a.logger.Error.Printf("failed to read token file(%v): %v", a.config.AgentTokenFile, err2)
 			return err2
 		} else {
 			token = string(data)
@@ -221,8 +221,8 @@ func readAgentKeyAndCerts(params map[string]string) error {
 
 
 
-	url, err := config.RegistrationURL()
-	LogInfo("fetching agent key and certificates from: %v", url)
+	url, err := a.config.RegistrationURL()
+	a.logger.Info.Printf("fetching agent key and certificates from: %v", url)
 	if err != nil {
 		return err
 	}
@@ -243,8 +243,8 @@ func readAgentKeyAndCerts(params map[string]string) error {
 		return Err("Register failed, probably need approve agent registration on Server side")
 	}
 
-	ioutil.WriteFile(config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
-	ioutil.WriteFile(config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
+	ioutil.WriteFile(a.config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
+	ioutil.WriteFile(a.config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
 	return nil
 }
 
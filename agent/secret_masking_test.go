@@ -0,0 +1,78 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestMaskSecretInEveryConsoleOutput(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	assert.Nil(t, writeFile(wd, "s3cr3t", "file blocks directories"))
+	invalidTimeout := protocol.EchoCommand("with invalid timeout")
+	invalidTimeout.Timeout = "s3cr3t"
+
+	tests := []struct {
+		command *protocol.BuildCommand
+		status  string
+		output  string
+	}{
+		{protocol.EchoCommand("echo s3cr3t"), "Passed", "echo ********\n"},
+		{protocol.ExportCommand("TOKEN", "s3cr3t", "false"), "Passed", "setting environment variable 'TOKEN' to value '********'\n"},
+		{protocol.FailCommand("fail s3cr3t"), "Failed", "ERROR: fail ********\n"},
+		{protocol.ExecCommand("s3cr3t"), "Failed", "ERROR: exec: \"********\": executable file not found in $PATH\n"},
+		{protocol.ExecCommand("sh", "-c", "echo stdout s3cr3t; echo stderr s3cr3t >&2; exit 1"), "Failed", "stdout ********\nstderr ********\nERROR: exit status 1\n"},
+		{protocol.TestCommand("-f", "missing-s3cr3t"), "Failed", "ERROR: stat " + wd + "/missing-********: no such file or directory\n"},
+		{protocol.CondCommand(protocol.TestCommand("-d", "."), protocol.FailCommand("cond s3cr3t")), "Failed", "ERROR: cond ********\n"},
+		{protocol.AndCommand(protocol.FailCommand("and s3cr3t")), "Failed", "ERROR: and ********\n"},
+		{protocol.OrCommand(protocol.FailCommand("or s3cr3t")), "Failed", "ERROR: or ********\n"},
+		{protocol.ComposeCommand(protocol.FailCommand("compose s3cr3t")), "Failed", "ERROR: compose ********\n"},
+		{protocol.ParallelCommand(protocol.FailCommand("parallel s3cr3t")), "Failed", "[1] ERROR: parallel ********\nERROR: Parallel commands failed: 1\n"},
+		{protocol.RetryCommand(2, protocol.FailCommand("retry s3cr3t")).AddArg("backoff", "1ms"), "Failed", "Attempt 1 of 2 failed: retry ********, retry in 1ms\nERROR: fail failed after 2 attempts: retry ********\n"},
+		{protocol.MkdirsCommand("s3cr3t/dir"), "Failed", "ERROR: mkdir " + wd + "/********: not a directory\n"},
+		{protocol.CleandirCommand("missing-s3cr3t"), "Failed", "ERROR: open " + wd + "/missing-********: no such file or directory\n"},
+		{protocol.UploadArtifactCommand("missing-s3cr3t.txt", "", "false"), "Failed", "ERROR: stat " + wd + "/missing-********.txt: no such file or directory\n"},
+		{protocol.DownloadFileCommand("src", "/url", "dest", "%zz-s3cr3t", "checksum"), "Failed", "ERROR: parse \"%zz-********\": invalid URL escape \"%zz\"\n"},
+		{protocol.DownloadDirCommand("src", "/url", "dest", "%zz-s3cr3t", "checksum"), "Failed", "ERROR: parse \"%zz-********\": invalid URL escape \"%zz\"\n"},
+		{protocol.GenerateTestReportCommand("s3cr3t/reports", "missing.xml"), "Failed", "ERROR: mkdir " + wd + "/********: not a directory\n"},
+		{protocol.GeneratePropertyCommand("name", "missing-s3cr3t.xml", "/a"), "Passed", "Failed to create property name. File " + wd + "/missing-********.xml does not exist.\n"},
+		{invalidTimeout, "Failed", "ERROR: Invalid timeout ******** of echo: time: invalid duration \"********\"\n"},
+	}
+
+	defer func(id string) { buildId = id }(buildId)
+	for i, test := range tests {
+		buildId = Sprintf("TestMaskSecretInEveryConsoleOutput%v", i)
+		stateLog.Reset(buildId, AgentId)
+		goServer.SendBuild(AgentId, buildId,
+			protocol.SecretCommand("s3cr3t"),
+			test.command.Setwd(relativePath(wd)),
+		)
+
+		assert.Equal(t, "agent Building", stateLog.Next())
+		assert.Equal(t, "build "+test.status, stateLog.Next())
+		assert.Equal(t, "agent Idle", stateLog.Next())
+
+		log, err := goServer.ConsoleLog(buildId)
+		assert.Nil(t, err)
+		assert.Equal(t, test.output, trimTimestamp(log), test.command.Name)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"time"
+)
+
+const (
+	ExitCodeDrained            = 0
+	ExitCodeBuildCanceled      = 1
+	ExitCodeReportNotDelivered = 2
+)
+
+// Shutdown drains the default agent, see Agent.Shutdown.
+func Shutdown(timeout time.Duration, force chan bool) int {
+	return defaultAgent.Shutdown(timeout, force)
+}
+
+// Shutdown drains the agent: new builds are refused, the current build
+// gets until timeout to finish before it is canceled (closing force cancels
+// it right away), and then the final reports are flushed to the server.
+// The returned value is meant to be used as the process exit code.
+func (a *Agent) Shutdown(timeout time.Duration, force chan bool) int {
+	a.drainLock.Lock()
+	if !isClosedChan(a.draining) {
+		close(a.draining)
+	}
+	a.drainLock.Unlock()
+	// let the server know it should not assign builds any more
+	a.ping()
+	code := ExitCodeDrained
+	finished := a.buildsFinished()
+
+	a.logger.Info.Printf("shutting down, wait %v for current build to finish", timeout)
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		a.logger.Info.Printf("build did not finish in %v, cancel it", timeout)
+		code = ExitCodeBuildCanceled
+		a.closeBuildSession()
+	case <-force:
+		a.logger.Info.Printf("cancel current build")
+		code = ExitCodeBuildCanceled
+		a.closeBuildSession()
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(CancelBuildTimeout):
+		a.logger.Error.Printf("build did not stop in %v after it was canceled", CancelBuildTimeout)
+	}
+
+	if !a.outbox.Flush(a.config.SendMessageTimeout) {
+		a.logger.Error.Printf("build reports were not delivered in %v, they will be sent when agent starts again", a.config.SendMessageTimeout)
+		code = ExitCodeReportNotDelivered
+	}
+	a.logger.Info.Printf("<<<<<<< go <<<<<<<")
+	return code
+}
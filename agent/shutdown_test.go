@@ -0,0 +1,105 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForBuildToFinish(t *testing.T) {
+	a, _, cleanup := startAnotherAgent(t, "TestShutdownWaitsForBuildToFinish")
+	defer cleanup()
+
+	goServer.SendBuild(a.Id, buildId, protocol.ExecCommand("sleep", "0.5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	code := shutdown(a, 5*time.Second, nil)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Unknown", stateLog.Next())
+	assert.Equal(t, ExitCodeDrained, <-code)
+}
+
+func TestShutdownCancelsBuildAfterTimeout(t *testing.T) {
+	a, _, cleanup := startAnotherAgent(t, "TestShutdownCancelsBuildAfterTimeout")
+	defer cleanup()
+
+	goServer.SendBuild(a.Id, buildId, protocol.ExecCommand("sleep", "5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	code := shutdown(a, 100*time.Millisecond, nil)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Unknown", stateLog.Next())
+	assert.Equal(t, ExitCodeBuildCanceled, <-code)
+}
+
+func TestForceShutdownCancelsBuild(t *testing.T) {
+	a, _, cleanup := startAnotherAgent(t, "TestForceShutdownCancelsBuild")
+	defer cleanup()
+
+	goServer.SendBuild(a.Id, buildId, protocol.ExecCommand("sleep", "5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	force := make(chan bool)
+	code := shutdown(a, time.Minute, force)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	close(force)
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Unknown", stateLog.Next())
+	assert.Equal(t, ExitCodeBuildCanceled, <-code)
+}
+
+func TestShutdownReportsUndeliveredBuildReports(t *testing.T) {
+	a, _, cleanup := startAnotherAgent(t, "TestShutdownReportsUndeliveredBuildReports")
+	defer cleanup()
+	goServer.SetWithholdAcks(true)
+	defer goServer.SetWithholdAcks(false)
+
+	goServer.SendBuild(a.Id, buildId, echo("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+
+	// the report is resent until it is acknowledged
+	code := shutdown(a, time.Second, nil)
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, ExitCodeReportNotDelivered, <-code)
+}
+
+func TestRejectBuildWhileShuttingDown(t *testing.T) {
+	a, _, cleanup := startAnotherAgent(t, "TestRejectBuildWhileShuttingDown")
+	defer cleanup()
+
+	assert.Equal(t, ExitCodeDrained, <-shutdown(a, time.Second, nil))
+	assert.Equal(t, "agent Unknown", stateLog.Next())
+
+	goServer.SendBuild(a.Id, buildId, echo("hello"))
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "", a.GetState("buildLocator"))
+}
+
+func shutdown(a *Agent, timeout time.Duration, force chan bool) chan int {
+	code := make(chan int, 1)
+	go func() {
+		code <- a.Shutdown(timeout, force)
+	}()
+	return code
+}
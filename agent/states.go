@@ -19,48 +19,58 @@ package agent
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"runtime"
-	"sync"
 )
 
-var state = map[string]string{
-	"runtimeStatus": "Idle",
-}
-
-var lock sync.Mutex
-
 func SetState(key, value string) {
-	lock.Lock()
-	defer lock.Unlock()
-	LogInfo("set %v to %v", key, value)
-	state[key] = value
+	defaultAgent.SetState(key, value)
 }
 
 func GetState(key string) string {
-	lock.Lock()
-	defer lock.Unlock()
-	return state[key]
+	return defaultAgent.GetState(key)
 }
 
 func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
+	return defaultAgent.RuntimeInfo()
+}
+
+func (a *Agent) SetState(key, value string) {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	a.logger.Info.Printf("set %v to %v", key, value)
+	a.state[key] = value
+}
+
+func (a *Agent) GetState(key string) string {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	return a.state[key]
+}
+
+func (a *Agent) RuntimeInfo() *protocol.AgentRuntimeInfo {
+	status := a.GetState("runtimeStatus")
+	if status == "Idle" && isClosedChan(a.draining) {
+		// server only assigns builds to idle agents
+		status = "Unknown"
+	}
 	info := protocol.AgentRuntimeInfo{
 		Identifier: &protocol.AgentIdentifier{
-			HostName:  config.Hostname,
-			IpAddress: config.IpAddress,
-			Uuid:      AgentId,
+			HostName:  a.config.Hostname,
+			IpAddress: a.config.IpAddress,
+			Uuid:      a.Id,
 		},
 		BuildingInfo: &protocol.AgentBuildingInfo{
-			BuildingInfo: GetState("buildLocatorForDisplay"),
-			BuildLocator: GetState("buildLocator"),
+			BuildingInfo: a.GetState("buildLocatorForDisplay"),
+			BuildLocator: a.GetState("buildLocator"),
 		},
-		RuntimeStatus:                GetState("runtimeStatus"),
-		Location:                     config.WorkingDir,
-		UsableSpace:                  UsableSpace(),
+		RuntimeStatus:                status,
+		Location:                     a.config.WorkingDir,
+		UsableSpace:                  a.UsableSpace(),
 		OperatingSystemName:          runtime.GOOS,
-		ElasticPluginId:              config.AgentAutoRegisterElasticPluginId,
-		ElasticAgentId:               config.AgentAutoRegisterElasticAgentId,
+		ElasticPluginId:              a.config.AgentAutoRegisterElasticPluginId,
+		ElasticAgentId:               a.config.AgentAutoRegisterElasticAgentId,
 		SupportsBuildCommandProtocol: true,
 	}
-	if cookie := GetState("cookie"); cookie != "" {
+	if cookie := a.GetState("cookie"); cookie != "" {
 		info.Cookie = cookie
 	}
 	return &info
@@ -17,16 +17,30 @@
 package agent
 
 import (
+	"github.com/bmatcuk/doublestar"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// CommandTest checks "left" against output of its sub command for -eq,
+// -neq, -in (left contains output), -nin, -match (output matches regex
+// left) and -nmatch; -exit checks the exit code of the sub command.
+// Flags without sub command are -d, -nd, -f, -nf, -glob (pattern left
+// matches any file), -grep (file left contains regex "right"), -newer
+// (file left is newer than file "right"), -env (variable left is not
+// empty), -enveq (variable left equals "right") and numeric -lt and -gt
+// comparing left with "right".
 func CommandTest(s *BuildSession, cmd *protocol.BuildCommand) error {
 	flag := cmd.Args["flag"]
+	right := cmd.Args["right"]
 
-	if flag == "-eq" || flag == "-neq" || flag == "-in" || flag == "-nin" {
+	if flag == "-eq" || flag == "-neq" || flag == "-in" || flag == "-nin" || flag == "-match" || flag == "-nmatch" {
 		output, err := s.processTestCommand(cmd.SubCommands[0])
 		if err != nil {
 			s.debugLog("test -eq exec command error: %v", err)
@@ -50,10 +64,51 @@ func CommandTest(s *BuildSession, cmd *protocol.BuildCommand) error {
 			if strings.Contains(expected, actual) {
 				return Err("expected command to not contain '%v'", expected)
 			}
+		} else {
+			regex, err := regexp.Compile(cmd.Args["left"])
+			if err != nil {
+				return Err("Invalid regex %v: %v", cmd.Args["left"], err)
+			}
+			if flag == "-match" && !regex.MatchString(actual) {
+				return Err("expected '%v' to match %v", actual, regex)
+			}
+			if flag == "-nmatch" && regex.MatchString(actual) {
+				return Err("expected '%v' to not match %v", actual, regex)
+			}
 		}
 		return nil
 	}
 
+	switch flag {
+	case "-exit":
+		return testExitCode(s, cmd)
+	case "-glob":
+		matches, err := doublestar.Glob(filepath.Join(s.wd, cmd.Args["left"]))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return Err("no file matches %v", cmd.Args["left"])
+		}
+		return nil
+	case "-grep":
+		return testFileContains(filepath.Join(s.wd, cmd.Args["left"]), right)
+	case "-newer":
+		return testFileNewer(filepath.Join(s.wd, cmd.Args["left"]), filepath.Join(s.wd, right))
+	case "-env":
+		if s.Getenv(cmd.Args["left"]) == "" {
+			return Err("environment variable %v is not set", cmd.Args["left"])
+		}
+		return nil
+	case "-enveq":
+		if value := s.Getenv(cmd.Args["left"]); value != right {
+			return Err("expected environment variable %v to be '%v', but was '%v'", cmd.Args["left"], right, value)
+		}
+		return nil
+	case "-lt", "-gt":
+		return testNumbers(flag, cmd.Args["left"], right)
+	}
+
 	targetPath := filepath.Join(s.wd, cmd.Args["left"])
 	info, err := os.Stat(targetPath)
 	switch flag {
@@ -103,3 +158,69 @@ func CommandTest(s *BuildSession, cmd *protocol.BuildCommand) error {
 
 	return Err("unknown test flag: %v", flag)
 }
+
+func testExitCode(s *BuildSession, cmd *protocol.BuildCommand) error {
+	expected, err := strconv.Atoi(cmd.Args["left"])
+	if err != nil {
+		return Err("Invalid exit code: %v", cmd.Args["left"])
+	}
+	_, err = s.processTestCommand(cmd.SubCommands[0])
+	actual := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		actual = exitErr.ExitCode()
+	} else if err != nil {
+		return err
+	}
+	if actual != expected {
+		return Err("expected exit code %v, but was %v", expected, actual)
+	}
+	return nil
+}
+
+func testFileContains(file, expr string) error {
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return Err("Invalid regex %v: %v", expr, err)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !regex.Match(content) {
+		return Err("%v does not contain %v", file, expr)
+	}
+	return nil
+}
+
+func testFileNewer(file, other string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	otherInfo, err := os.Stat(other)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(otherInfo.ModTime()) {
+		return Err("%v is not newer than %v", file, other)
+	}
+	return nil
+}
+
+func testNumbers(flag, left, right string) error {
+	l, err := strconv.ParseFloat(strings.TrimSpace(left), 64)
+	if err != nil {
+		return Err("%v is not a number", left)
+	}
+	r, err := strconv.ParseFloat(strings.TrimSpace(right), 64)
+	if err != nil {
+		return Err("%v is not a number", right)
+	}
+	if flag == "-lt" && !(l < r) {
+		return Err("expected %v to be less than %v", left, right)
+	}
+	if flag == "-gt" && !(l > r) {
+		return Err("expected %v to be greater than %v", left, right)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+func TestExecTimeout(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").SetTimeout(100*time.Millisecond).SetOnCancel(echo("exec on cancel")),
+		echo("should not process this echo"),
+		echo("after timeout").RunIf("any"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `Terminating processes: <pids>
+exec on cancel
+ERROR: exec timed out after 100ms
+after timeout
+`
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
+}
+
+func TestComposeTimeoutCancelsSubCommands(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ComposeCommand(
+			echo("before sleep"),
+			protocol.ExecCommand("sleep", "5").SetOnCancel(echo("sleep on cancel")),
+			echo("should not process this echo").RunIf("any"),
+		).SetTimeout(200*time.Millisecond).SetOnCancel(echo("compose on cancel")),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `before sleep
+Terminating processes: <pids>
+sleep on cancel
+compose on cancel
+ERROR: compose timed out after 200ms
+`
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
+}
+
+func TestCommandsFinishedBeforeTimeout(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		echo("hello").SetTimeout(5*time.Second),
+		protocol.ComposeCommand(
+			protocol.FailCommand("something is wrong"),
+		).SetTimeout(5*time.Second),
+		echo("hello again").RunIf("failed").SetTimeout(5*time.Second),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `hello
+ERROR: something is wrong
+hello again
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestExportBeforeTimeoutIsKept(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ComposeCommand(
+			protocol.ExportCommand("GREETING", "hello", "false"),
+			protocol.UnsetCommand("HOME"),
+		).SetTimeout(5*time.Second),
+		protocol.ExecCommand("sh", "-c", "echo $GREETING ${HOME:-unset}"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `setting environment variable 'GREETING' to value 'hello'
+unsetting environment variable 'HOME'
+hello unset
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestInvalidTimeout(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	cmd := echo("hello")
+	cmd.Timeout = "forever"
+	goServer.SendBuild(AgentId, buildId, cmd)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: Invalid timeout forever of echo: time: invalid duration \"forever\"\n", trimTimestamp(log))
+}
+
+func TestCancelBuildWhileCommandHasTimeout(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sleep", "5").SetTimeout(time.Minute).SetOnCancel(echo("exec on cancel")),
+		echo("should not process this echo").RunIf("any"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := `Terminating processes: <pids>
+exec on cancel
+`
+	assert.Equal(t, expected, maskPids(trimTimestamp(log)))
+}
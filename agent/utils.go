@@ -18,9 +18,9 @@ package agent
 
 import (
 	"bytes"
-	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/url"
 	"os"
@@ -71,7 +71,7 @@ func AppendUrlParam(base *url.URL, paramName, paramValue string) *url.URL {
 	url, _ := url.Parse(base.String())
 	values := url.Query()
 	values.Set(paramName, paramValue)
-	base.RawQuery = values.Encode()
+	url.RawQuery = values.Encode()
 	return url
 }
 
@@ -138,17 +138,36 @@ func ParseChecksum(checksum string) map[string]string {
 }
 
 func ComputeMd5(filePath string) (string, error) {
+	checksums, err := ComputeChecksums(filePath, []string{"md5"})
+	return checksums["md5"], err
+}
+
+// ComputeChecksums computes hex checksums of a file for each of the given
+// algorithms in one pass.
+func ComputeChecksums(filePath string, algorithms []string) (map[string]string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		newHash, ok := checksumHashes[algorithm]
+		if !ok {
+			return nil, Err("Unknown checksum algorithm: %v", algorithm)
+		}
+		hashes[algorithm] = newHash()
+		writers = append(writers, hashes[algorithm])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, err
 	}
 
-	var result []byte
-	return Sprintf("%x", hash.Sum(result)), nil
+	checksums := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		checksums[algorithm] = Sprintf("%x", h.Sum(nil))
+	}
+	return checksums, nil
 }
@@ -19,25 +19,28 @@ package agent
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
-	"time"
 )
 
 type WebsocketConnection struct {
-	Conn     *websocket.Conn
-	Send     chan *protocol.Message
-	Received chan *protocol.Message
+	Conn        *websocket.Conn
+	Received    chan *protocol.Message
+	Acknowledge chan string
+	logger      *Logger
+}
+
+func (wc *WebsocketConnection) Write(msg *protocol.Message) error {
+	return protocol.SendMessage(wc.Conn, msg)
 }
 
 func (wc *WebsocketConnection) Close() {
-	close(wc.Send)
 	err := wc.Conn.Close()
 	if err != nil {
-		logger.Error.Printf("Close websocket connection failed: %v", err)
+		wc.logger.Error.Printf("Close websocket connection failed: %v", err)
 	}
 }
 
-func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error) {
-	tlsConfig, err := GoServerTlsConfig(true)
+func (a *Agent) MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error) {
+	tlsConfig, err := a.GoServerTlsConfig(true)
 	if err != nil {
 		return nil, err
 	}
@@ -46,69 +49,20 @@ func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error
 		return nil, err
 	}
 	wsConfig.TlsConfig = tlsConfig
-	LogInfo("connect to: %v", wsLoc)
+	a.logger.Info.Printf("connect to: %v", wsLoc)
 	ws, err := websocket.DialConfig(wsConfig)
 	if err != nil {
 		return nil, err
 	}
-	acknowledge := make(chan string)
-	send := make(chan *protocol.Message)
+	acknowledge := make(chan string, 10)
 	received := make(chan *protocol.Message)
 
-	go startReceiveMessage(ws, received, acknowledge)
-	go startSendMessage(ws, send, acknowledge)
-	return &WebsocketConnection{Conn: ws, Send: send, Received: received}, nil
+	go startReceiveMessage(ws, received, acknowledge, a.logger)
+	return &WebsocketConnection{Conn: ws, Received: received, Acknowledge: acknowledge, logger: a.logger}, nil
 }
 
-func startSendMessage(ws *websocket.Conn, send chan *protocol.Message, acknowledge chan string) {
-	defer LogDebug("! exit goroutine: send message")
-	connClosed := false
-loop:
-	select {
-	case id := <-acknowledge:
-		LogInfo("Ignore acknowledge with id: %v", id)
-	case msg, ok := <-send:
-		if !ok {
-			return
-		}
-		LogInfo("--> %v", msg.Action)
-		if connClosed {
-			logger.Error.Printf("send message failed: connection is closed")
-			goto loop
-		}
-		if err := protocol.SendMessage(ws, msg); err == nil {
-			waitForMessageAcknowledge(msg.AcknowledgeId, acknowledge)
-			goto loop
-		} else {
-			logger.Error.Printf("send message failed: %v", err)
-			if err := ws.Close(); err == nil {
-				connClosed = true
-			} else {
-				logger.Error.Printf("Close websocket connection failed: %v", err)
-			}
-		}
-	}
-	goto loop
-}
-
-func waitForMessageAcknowledge(acknowledgeId string, acknowledge chan string) {
-	for {
-		select {
-		case <-time.After(config.SendMessageTimeout):
-			LogInfo("wait for message acknowledge timeout, id: %v", acknowledgeId)
-			return
-		case id := <-acknowledge:
-			if id == acknowledgeId {
-				return
-			} else {
-				LogInfo("ignore acknowledge with id: %v, expected: %v", id, acknowledgeId)
-			}
-		}
-	}
-}
-
-func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, acknowledge chan string) {
-	defer LogDebug("! exit goroutine: receive message")
+func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, acknowledge chan string, logger *Logger) {
+	defer logger.Debug.Printf("! exit goroutine: receive message")
 	defer close(received)
 	for {
 		msg, err := protocol.ReceiveMessage(ws)
@@ -116,10 +70,14 @@ func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ac
 			logger.Error.Printf("receive message failed: %v", err)
 			return
 		}
-		LogInfo("<-- %v", msg.Action)
+		logger.Info.Printf("<-- %v", msg.Action)
 
-		if msg.Action == "acknowledge" {
-			acknowledge <- msg.DataString()
+		if msg.Action == protocol.AckAction {
+			select {
+			case acknowledge <- msg.DataString():
+			default:
+				logger.Info.Printf("Ignore acknowledge with id: %v", msg.DataString())
+			}
 		} else {
 			received <- msg
 		}
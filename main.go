@@ -17,11 +17,15 @@
 package main
 
 import (
-	"github.com/gocd-contrib/gocd-golang-agent/agent"
-	"time"
+	"context"
 	"flag"
 	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -30,6 +34,9 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runLocal(os.Args[2:]))
+	}
 
 	versonPtr := flag.Bool("version", false, "Show GoCD Golang Agent Verson")
 	flag.Parse()
@@ -40,6 +47,7 @@ func main() {
 	}
 
 	agent.Initialize()
+	go shutdownOnSignal()
 	for {
 		err := agent.Start()
 		if err != nil {
@@ -49,3 +57,63 @@ func main() {
 		time.Sleep(10 * time.Second)
 	}
 }
+
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	agent.LogInfo("received %v, stop accepting builds", sig)
+	force := make(chan bool)
+	go func() {
+		sig := <-signals
+		agent.LogInfo("received %v again, cancel current build", sig)
+		close(force)
+	}()
+	os.Exit(agent.Shutdown(agent.GetConfig().ShutdownTimeout, force))
+}
+
+// runLocal runs a build JSON file without Go server, the exit code is 0
+// when the build passed, 1 when it failed, 2 when it was canceled and 3
+// when it could not be started.
+func runLocal(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	wd := flags.String("wd", ".", "Build working directory")
+	output := flags.String("output", "artifacts", "Directory to save uploaded artifacts and test reports")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gocd-golang-agent run [options] <build.json>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 3
+	}
+
+	build, err := agent.ReadBuildFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	logger := agent.MakeWriterLogger(os.Stderr, os.Getenv("DEBUG") != "")
+	status, err := agent.RunLocal(ctx, build, *wd, *output, os.Stdout, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	switch status {
+	case protocol.BuildPassed:
+		return 0
+	case protocol.BuildFailed:
+		return 1
+	default:
+		return 2
+	}
+}
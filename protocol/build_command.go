@@ -18,7 +18,9 @@ package protocol
 
 import (
 	"encoding/json"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -29,9 +31,13 @@ const (
 	ExecInput         = ""
 
 	CommandCompose             = "compose"
+	CommandParallel            = "parallel"
+	CommandRetry               = "retry"
+	CommandForeach             = "foreach"
 	CommandCond                = "cond"
 	CommandAnd                 = "and"
 	CommandOr                  = "or"
+	CommandNot                 = "not"
 	CommandExport              = "export"
 	CommandTest                = "test"
 	CommandExec                = "exec"
@@ -43,6 +49,8 @@ const (
 	CommandCleandir            = "cleandir"
 	CommandFail                = "fail"
 	CommandSecret              = "secret"
+	CommandSecretFile          = "secretFile"
+	CommandCapture             = "capture"
 	CommandDownloadFile        = "downloadFile"
 	CommandDownloadDir         = "downloadDir"
 	CommandGenerateTestReport  = "generateTestReport"
@@ -58,6 +66,8 @@ type BuildCommand struct {
 	WorkingDirectory string
 	Test             *BuildCommand
 	OnCancel         *BuildCommand
+	Timeout          string
+	AllowFailure     bool
 }
 
 func NewBuildCommand(name string) *BuildCommand {
@@ -85,6 +95,23 @@ func ComposeCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand(CommandCompose).AddCommands(commands...)
 }
 
+func ParallelCommand(commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandParallel).AddCommands(commands...)
+}
+
+// RetryCommand retries commands[0], commands[1] is an optional test
+// deciding whether a failure is retryable.
+func RetryCommand(attempts int, commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandRetry).AddArg("attempts", strconv.Itoa(attempts)).AddCommands(commands...)
+}
+
+// ForeachCommand processes commands for each item of a list arg "items",
+// lines of "file" or files matching "glob", with the item exported as
+// environment variable name.
+func ForeachCommand(name string, commands ...*BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandForeach).AddArg("name", name).AddCommands(commands...)
+}
+
 func CondCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand("cond").AddCommands(commands...)
 }
@@ -97,6 +124,10 @@ func OrCommand(commands ...*BuildCommand) *BuildCommand {
 	return NewBuildCommand("or").AddCommands(commands...)
 }
 
+func NotCommand(command *BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandNot).AddCommands(command)
+}
+
 func EchoCommand(line string) *BuildCommand {
 	return NewBuildCommand(CommandEcho).AddArg("line", line)
 }
@@ -114,6 +145,33 @@ func ExportCommand(kvs ...string) *BuildCommand {
 	return NewBuildCommand(CommandExport).SetArgs(args)
 }
 
+// UnsetCommand removes environment variable name from the build.
+func UnsetCommand(name string) *BuildCommand {
+	return NewBuildCommand(CommandExport).AddArg("op", "unset").AddArg("name", name)
+}
+
+// PrependPathCommand adds value to the front of path list variable name,
+// separated by the OS path list separator.
+func PrependPathCommand(name, value string) *BuildCommand {
+	return NewBuildCommand(CommandExport).AddArg("op", "prepend").AddArg("name", name).AddArg("value", value)
+}
+
+// AppendPathCommand adds value to the end of path list variable name.
+func AppendPathCommand(name, value string) *BuildCommand {
+	return NewBuildCommand(CommandExport).AddArg("op", "append").AddArg("name", name).AddArg("value", value)
+}
+
+// LoadEnvCommand exports all variables of a dotenv or properties file.
+func LoadEnvCommand(file, secure string) *BuildCommand {
+	return NewBuildCommand(CommandExport).AddArg("op", "load").AddArg("file", file).AddArg("secure", secure)
+}
+
+// CaptureCommand exports output of command as environment variable name,
+// set arg "regex" to extract a part of it and "secure" to mask it.
+func CaptureCommand(name string, command *BuildCommand) *BuildCommand {
+	return NewBuildCommand(CommandCapture).AddArg("name", name).AddCommands(command)
+}
+
 func ReportCurrentStatusCommand(jobState string) *BuildCommand {
 	args := map[string]string{"status": jobState}
 	return NewBuildCommand(CommandReportCurrentStatus).SetArgs(args)
@@ -143,6 +201,18 @@ func SecretCommand(vs ...string) *BuildCommand {
 	return NewBuildCommand(CommandSecret).SetArgs(args)
 }
 
+// SecretFileCommand writes value to a file and exports its path as
+// environment variable name, without path the file is created in a private
+// directory of the build.
+func SecretFileCommand(name, value, path string) *BuildCommand {
+	args := map[string]string{
+		"name":  name,
+		"value": value,
+		"path":  path,
+	}
+	return NewBuildCommand(CommandSecretFile).SetArgs(args)
+}
+
 func FailCommand(msg string) *BuildCommand {
 	args := map[string]string{"message": msg}
 	return NewBuildCommand(CommandFail).SetArgs(args)
@@ -185,6 +255,15 @@ func DownloadCommand(file_or_dir, src, url, dest, checksumUrl, checksumPath stri
 	return NewBuildCommand(file_or_dir).SetArgs(args)
 }
 
+func GeneratePropertyCommand(name, src, xpath string) *BuildCommand {
+	args := map[string]string{
+		"name":  name,
+		"src":   src,
+		"xpath": xpath,
+	}
+	return NewBuildCommand(CommandGenerateProperty).SetArgs(args)
+}
+
 func GenerateTestReportCommand(args ...string) *BuildCommand {
 	return NewBuildCommand(CommandGenerateTestReport).AddArg("uploadPath", args[0]).AddListArg("srcs", args[1:])
 }
@@ -248,6 +327,18 @@ func (cmd *BuildCommand) SetOnCancel(c *BuildCommand) *BuildCommand {
 	return cmd
 }
 
+// SetAllowFailure makes failure of the command a warning instead of failing
+// the build.
+func (cmd *BuildCommand) SetAllowFailure(allow bool) *BuildCommand {
+	cmd.AllowFailure = allow
+	return cmd
+}
+
+func (cmd *BuildCommand) SetTimeout(timeout time.Duration) *BuildCommand {
+	cmd.Timeout = timeout.String()
+	return cmd
+}
+
 func (cmd *BuildCommand) ListArg(name string) (list []string, err error) {
 	err = json.Unmarshal([]byte(cmd.Args[name]), &list)
 	return
@@ -19,12 +19,14 @@ package server
 import (
 	"archive/zip"
 	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/ziputil"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func artifactsHandler(s *Server) func(http.ResponseWriter, *http.Request) {
@@ -46,6 +48,8 @@ func handleArtifactDownload(s *Server, w http.ResponseWriter, req *http.Request)
 	var fullPath string
 	if len(file) == 1 {
 		fullPath = s.ArtifactFile(buildId, file[0])
+	} else if algorithm := req.URL.Query().Get("checksum"); algorithm != "" {
+		fullPath = s.AlgorithmChecksumFile(buildId, algorithm)
 	} else {
 		fullPath = s.ChecksumFile(buildId)
 	}
@@ -92,20 +96,24 @@ func handleArtifactsUpload(s *Server, w http.ResponseWriter, req *http.Request)
 		if err == io.EOF {
 			break
 		}
-		switch part.FormName() {
-		case "zipfile":
+		switch name := part.FormName(); {
+		case name == "zipfile":
 			err = extractToArtifactDir(s, buildId, part)
 			if err != nil {
 				s.responseInternalError(err, w)
 				return
 			}
-		case "file_checksum":
+		case strings.HasPrefix(name, "file_checksum"):
 			bytes, err := ioutil.ReadAll(part)
 			if err != nil {
 				s.responseInternalError(err, w)
 				return
 			}
-			err = s.appendToFile(s.ChecksumFile(buildId), bytes)
+			file := s.ChecksumFile(buildId)
+			if algorithm := strings.TrimPrefix(name, "file_checksum_"); algorithm != name {
+				file = s.AlgorithmChecksumFile(buildId, algorithm)
+			}
+			err = s.appendToFile(file, bytes)
 			if err != nil {
 				s.responseInternalError(err, w)
 				return
@@ -125,34 +133,7 @@ func extractToArtifactDir(s *Server, buildId string, part *multipart.Part) error
 	if err != nil {
 		return err
 	}
-	for _, file := range zipReader.File {
-		dest := s.ArtifactFile(buildId, file.FileHeader.Name)
-		err := extractArtifactFile(file, dest)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func extractArtifactFile(file *zip.File, dest string) error {
-	rc, err := file.Open()
-	if err != nil {
-		return err
-	}
-	defer rc.Close()
-
-	err = os.MkdirAll(filepath.Dir(dest), 0755)
-	if err != nil {
-		return err
-	}
-	destFile, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-	_, err = io.Copy(destFile, rc)
-	return err
+	return ziputil.Extract(zipReader, s.ArtifactFile(buildId, ""), ziputil.SymlinkInside)
 }
 
 func zipDirecotry(source string) (string, error) {
@@ -172,19 +153,7 @@ func zipDirecotry(source string) (string, error) {
 			return nil
 		}
 
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		destFile := dirName + path[len(source):]
-		writer, err := w.Create(destFile)
-		if err != nil {
-			return err
-		}
-
-		_, err = io.Copy(writer, file)
-		return err
+		return ziputil.Add(w, path, dirName+path[len(source):])
 	})
 	return zipfile.Name(), err
 
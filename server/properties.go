@@ -0,0 +1,51 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func propertiesHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, PropertiesPath+"/builds/"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			s.responseBadRequest(errors.New("invalid property url: "+req.URL.Path), w)
+			return
+		}
+		buildId, name := parts[0], parts[1]
+		value := req.PostFormValue("value")
+		s.log("set property %v = %v for build %v", name, value, buildId)
+		file := s.PropertyFile(buildId, name)
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(file, []byte(value), 0644)
+		}
+		if err != nil {
+			s.responseInternalError(err, w)
+		}
+	}
+}
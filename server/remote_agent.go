@@ -44,8 +44,9 @@ func (agent *RemoteAgent) Listen(server *Server) error {
 
 func (agent *RemoteAgent) processMessage(server *Server, msg *protocol.Message) {
 	server.log("received message: %v", msg.Action)
-	err := agent.Ack(msg)
-	if err != nil {
+	if server.WithholdAcks() {
+		server.log("withhold ack of message: %v", msg.Action)
+	} else if err := agent.Ack(msg); err != nil {
 		server.error("ack error: %v", err)
 	}
 	switch msg.Action {
@@ -57,6 +57,7 @@ type Server struct {
 	Logger               *log.Logger
 	StateListeners       []StateListener
 	maxRequestEntitySize int64
+	withholdAcks         bool
 	fieldChangeMu        sync.Mutex
 
 	addAgent    chan *RemoteAgent
@@ -84,6 +85,7 @@ func (s *Server) Start() error {
 	s.HandleFunc(RegistrationPath, registorHandler(s))
 	s.HandleFunc(ConsoleLogPath+"/", consoleHandler(s))
 	s.HandleFunc(ArtifactsPath+"/", artifactsHandler(s))
+	s.HandleFunc(PropertiesPath+"/", propertiesHandler(s))
 	s.HandleFunc(StatusPath, statusHandler())
 	s.log("listen to %v", s.Address)
 	return http.ListenAndServeTLS(s.Address, s.CertPemFile, s.KeyPemFile, nil)
@@ -117,6 +119,20 @@ func (s *Server) MaxRequestEntitySize() int64 {
 	return s.maxRequestEntitySize
 }
 
+// SetWithholdAcks stops acknowledging agent messages when true, to
+// simulate a server that does not respond.
+func (s *Server) SetWithholdAcks(withhold bool) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.withholdAcks = withhold
+}
+
+func (s *Server) WithholdAcks() bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.withholdAcks
+}
+
 func (s *Server) ConsoleLog(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ConsoleLogFile(buildId))
 	return string(bytes), err
@@ -127,6 +143,11 @@ func (s *Server) Checksum(buildId string) (string, error) {
 	return string(bytes), err
 }
 
+func (s *Server) AlgorithmChecksum(buildId, algorithm string) (string, error) {
+	bytes, err := ioutil.ReadFile(s.AlgorithmChecksumFile(buildId, algorithm))
+	return string(bytes), err
+}
+
 func (s *Server) ChecksumUrl(buildId string) string {
 	return ArtifactsPath + "/builds/" + buildId
 }
@@ -140,13 +161,28 @@ func (s *Server) ArtifactUrl(buildId, file string) string {
 }
 
 func (s *Server) ChecksumFile(buildId string) string {
-	return filepath.Join(s.WorkingDir, buildId, "md5.checksum")
+	return s.AlgorithmChecksumFile(buildId, "md5")
+}
+
+// AlgorithmChecksumFile is the checksum file of artifacts uploaded with
+// form field file_checksum_<algorithm>, and file_checksum for md5.
+func (s *Server) AlgorithmChecksumFile(buildId, algorithm string) string {
+	return filepath.Join(s.WorkingDir, buildId, filepath.Base(algorithm)+".checksum")
 }
 
 func (s *Server) ConsoleLogFile(buildId string) string {
 	return filepath.Join(s.WorkingDir, buildId, "console.log")
 }
 
+func (s *Server) Property(buildId, name string) (string, error) {
+	bytes, err := ioutil.ReadFile(s.PropertyFile(buildId, name))
+	return string(bytes), err
+}
+
+func (s *Server) PropertyFile(buildId, name string) string {
+	return filepath.Join(s.WorkingDir, buildId, "properties", name)
+}
+
 func (s *Server) Send(agentId string, msg *protocol.Message) {
 	s.sendMessage <- &AgentMessage{agentId: agentId, Msg: msg}
 }
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"io"
+)
+
+// LineWriter buffers output and writes it to the underlying writer one
+// complete line per Write call, so lines from writers sharing the same
+// underlying writer are not mixed up. Flush writes out the last incomplete
+// line.
+type LineWriter struct {
+	io.Writer
+	buf []byte
+}
+
+func NewLineWriter(writer io.Writer) *LineWriter {
+	return &LineWriter{Writer: writer}
+}
+
+func (w *LineWriter) Write(out []byte) (int, error) {
+	w.buf = append(w.buf, out...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(out), nil
+		}
+		line := make([]byte, i+1)
+		copy(line, w.buf)
+		w.buf = w.buf[i+1:]
+		if _, err := w.Writer.Write(line); err != nil {
+			return len(out), err
+		}
+	}
+}
+
+func (w *LineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	_, err := w.Writer.Write(line)
+	return err
+}
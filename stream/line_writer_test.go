@@ -0,0 +1,78 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"testing"
+)
+
+type recordWriter struct {
+	writes []string
+}
+
+func (w *recordWriter) Write(out []byte) (int, error) {
+	w.writes = append(w.writes, string(out))
+	return len(out), nil
+}
+
+func TestLineWriter(t *testing.T) {
+	var tests = []struct {
+		inputs []string
+		writes []string
+	}{
+		{[]string{"hello"}, nil},
+		{[]string{"hello\n"}, []string{"hello\n"}},
+		{[]string{"hel", "lo", "\n"}, []string{"hello\n"}},
+		{[]string{"hello\nworld\n"}, []string{"hello\n", "world\n"}},
+		{[]string{"hello\nwor", "ld\n!"}, []string{"hello\n", "world\n"}},
+		{[]string{"\n", "\n"}, []string{"\n", "\n"}},
+	}
+	for _, test := range tests {
+		w := &recordWriter{}
+		lw := NewLineWriter(w)
+		for _, d := range test.inputs {
+			size, err := lw.Write([]byte(d))
+			assert.Nil(t, err)
+			assert.Equal(t, len(d), size)
+		}
+		assert.Equal(t, test.writes, w.writes)
+	}
+}
+
+func TestLineWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLineWriter(&buf)
+	w.Write([]byte("hello\nworld"))
+	assert.Equal(t, "hello\n", buf.String())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "hello\nworld\n", buf.String())
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "hello\nworld\n", buf.String())
+}
+
+func TestLineWriterWithPrefixWriter(t *testing.T) {
+	w := &recordWriter{}
+	pw := NewPrefixWriter(NewLineWriter(w), func() []byte {
+		return []byte("[a] ")
+	})
+	pw.Write([]byte("hello"))
+	pw.Write([]byte(" world\nbye\n"))
+	assert.Equal(t, []string{"[a] hello world\n", "[a] bye\n"}, w.writes)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var MaskFlushDelay = 100 * time.Millisecond
+
+// MaskWriter replaces secrets with their masks. As a secret can be split
+// across Write calls, output that may be the beginning of a secret is held
+// back until following output shows whether it is, Flush or Close is
+// called, or nothing is written for MaskFlushDelay. Lines are written out
+// as soon as their newline is written, unless a secret spans lines.
+// Writers made by Filter share the secrets.
+type MaskWriter struct {
+	io.Writer
+	secrets *secrets
+	lock    sync.Mutex
+	buf     []byte
+	timer   *time.Timer
+}
+
+func NewMaskWriter(writer io.Writer) *MaskWriter {
+	return &MaskWriter{Writer: writer, secrets: &secrets{masks: make(map[string]string)}}
+}
+
+func (w *MaskWriter) Filter(writer io.Writer) *MaskWriter {
+	return &MaskWriter{Writer: writer, secrets: w.secrets}
+}
+
+// Add masks secret in output written from now on by w and writers sharing
+// its secrets.
+func (w *MaskWriter) Add(secret, mask string) {
+	w.secrets.add(secret, mask)
+}
+
+func (w *MaskWriter) Write(out []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, out...)
+	masked, pending := w.secrets.mask(w.buf, false)
+	w.buf = append(w.buf[:0], w.buf[len(w.buf)-pending:]...)
+	if len(w.buf) > 0 {
+		w.startTimer()
+	}
+	if len(masked) == 0 {
+		return len(out), nil
+	}
+	_, err := w.Writer.Write(masked)
+	return len(out), err
+}
+
+func (w *MaskWriter) startTimer() {
+	if w.timer == nil {
+		w.timer = time.AfterFunc(MaskFlushDelay, func() { w.Flush() })
+	} else {
+		w.timer.Reset(MaskFlushDelay)
+	}
+}
+
+// Flush writes out the output held back.
+func (w *MaskWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	masked, _ := w.secrets.mask(w.buf, true)
+	w.buf = w.buf[:0]
+	_, err := w.Writer.Write(masked)
+	return err
+}
+
+// Close flushes w, the underlying writer is not closed.
+func (w *MaskWriter) Close() error {
+	return w.Flush()
+}
+
+type secrets struct {
+	lock  sync.RWMutex
+	masks map[string]string
+	set   *secretSet
+}
+
+// secretSet is an immutable snapshot of secrets, it is replaced when a
+// secret is added.
+type secretSet struct {
+	matcher *matcher
+	lengths []int
+	masks   []string
+}
+
+func (s *secrets) add(secret, mask string) {
+	if secret == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.masks[secret] = mask
+	set := &secretSet{}
+	patterns := make([]string, 0, len(s.masks))
+	for secret, mask := range s.masks {
+		patterns = append(patterns, secret)
+		set.lengths = append(set.lengths, len(secret))
+		set.masks = append(set.masks, mask)
+	}
+	set.matcher = newMatcher(patterns)
+	s.set = set
+}
+
+// mask returns data with secrets replaced, except the last pending bytes
+// that may be the beginning of a secret. Overlapping secrets are replaced
+// together by the mask of the first one. Nothing is pending when final.
+func (s *secrets) mask(data []byte, final bool) (masked []byte, pending int) {
+	s.lock.RLock()
+	set := s.set
+	s.lock.RUnlock()
+	if set == nil {
+		return append([]byte(nil), data...), 0
+	}
+
+	matches, partial := set.matcher.scan(data, set.lengths)
+	if !final {
+		pending = partial
+	}
+	boundary := len(data) - pending
+	sort.Sort(byStart(matches))
+	pos := 0
+	for i := 0; i < len(matches) && matches[i].start < boundary; {
+		start, end := matches[i].start, matches[i].end
+		mask := set.masks[matches[i].pattern]
+		for i++; i < len(matches) && matches[i].start < end; i++ {
+			if matches[i].end > end {
+				end = matches[i].end
+			}
+		}
+		masked = append(masked, data[pos:start]...)
+		masked = append(masked, mask...)
+		pos = end
+	}
+	if pos < boundary {
+		masked = append(masked, data[pos:boundary]...)
+	} else {
+		// overlapping secrets may end in the pending bytes
+		pending = len(data) - pos
+	}
+	return masked, pending
+}
+
+// byStart sorts matches by start, longer ones first
+type byStart []match
+
+func (m byStart) Len() int      { return len(m) }
+func (m byStart) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byStart) Less(i, j int) bool {
+	return m[i].start < m[j].start || m[i].start == m[j].start && m[i].end > m[j].end
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/stream"
+	"github.com/xli/assert"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaskWriter(t *testing.T) {
+	var tests = []struct {
+		secrets map[string]string
+		inputs  []string
+		output  string
+	}{
+		{
+			map[string]string{"password": "****"},
+			[]string{"login with password\n"},
+			"login with ****\n",
+		},
+		{
+			map[string]string{"password": "****"},
+			[]string{"login with pass", "word\n"},
+			"login with ****\n",
+		},
+		{
+			map[string]string{"password": "****"},
+			[]string{"p", "a", "s", "s", "w", "o", "r", "d", "\n"},
+			"****\n",
+		},
+		{
+			map[string]string{"password": "****"},
+			[]string{"pas", "ta pass", "word"},
+			"pasta ****",
+		},
+		{
+			map[string]string{"secret": "******", "token": "#####"},
+			[]string{"secret: tok", "en, token: secr", "et"},
+			"******: #####, #####: ******",
+		},
+		{
+			map[string]string{"abc": "***", "bcd": "###"},
+			[]string{"xab", "cdx"},
+			"x***x",
+		},
+		{
+			map[string]string{"abc": "***", "abcdef": "######"},
+			[]string{"abcde", "f abcd"},
+			"###### ***d",
+		},
+		{
+			map[string]string{"aa": "*"},
+			[]string{"aaa", "aa"},
+			"**",
+		},
+		{
+			map[string]string{},
+			[]string{"nothing", " to mask"},
+			"nothing to mask",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewMaskWriter(&buf)
+		for secret, mask := range test.secrets {
+			w.Add(secret, mask)
+		}
+		for _, input := range test.inputs {
+			n, err := w.Write([]byte(input))
+			assert.Nil(t, err)
+			assert.Equal(t, len(input), n)
+		}
+		assert.Nil(t, w.Close())
+		assert.Equal(t, test.output, buf.String(), test.inputs)
+	}
+}
+
+func TestMaskWriterHoldsBackOnlyPossibleSecret(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewMaskWriter(&buf)
+	w.Add("password", "****")
+
+	w.Write([]byte("line 1\nline 2 pass"))
+	assert.Equal(t, "line 1\nline 2 ", buf.String())
+	w.Write([]byte("ed\n"))
+	assert.Equal(t, "line 1\nline 2 passed\n", buf.String())
+	w.Write([]byte("password"))
+	assert.Equal(t, "line 1\nline 2 passed\n", buf.String())
+	w.Flush()
+	assert.Equal(t, "line 1\nline 2 passed\n****", buf.String())
+}
+
+func TestMaskWriterFlushesWhenIdle(t *testing.T) {
+	defer func(delay time.Duration) { MaskFlushDelay = delay }(MaskFlushDelay)
+	MaskFlushDelay = 10 * time.Millisecond
+	out := &syncBuffer{}
+	w := NewMaskWriter(out)
+	w.Add("password", "****")
+
+	w.Write([]byte("$ pass"))
+	assert.Equal(t, "$ ", out.String())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "$ pass", out.String())
+}
+
+func TestMaskWriterFilterSharesSecrets(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	w1 := NewMaskWriter(&buf1)
+	w2 := w1.Filter(&buf2)
+	w1.Write([]byte("token"))
+	w2.Add("token", "*****")
+	w2.Write([]byte("to"))
+	w1.Write([]byte(" token"))
+	w2.Write([]byte("ken"))
+	w1.Close()
+	w2.Close()
+	assert.Equal(t, "token *****", buf1.String())
+	assert.Equal(t, "*****", buf2.String())
+}
+
+func TestMaskWriterWithRandomChunks(t *testing.T) {
+	secrets := map[string]string{
+		"s3cr3t":       "******",
+		"p@ss":         "####",
+		"ghp_123abc":   "[token]",
+		"multi\nline":  "[multi]",
+		"s3cr3t-admin": "[admin]",
+	}
+	input := "user p@ss s3cr3t p@ssp@ss\nmulti\nline s3cr3t-admin ghp_123ab ghp_123abc\nmulti s3cr3"
+	expected := "user #### ****** ########\n[multi] [admin] ghp_123ab [token]\nmulti s3cr3"
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		w := NewMaskWriter(&buf)
+		for secret, mask := range secrets {
+			w.Add(secret, mask)
+		}
+		rest := input
+		for len(rest) > 0 {
+			n := rand.Intn(len(rest)) + 1
+			w.Write([]byte(rest[:n]))
+			rest = rest[n:]
+		}
+		w.Close()
+		assert.Equal(t, expected, buf.String())
+	}
+}
+
+func TestMaskWriterConcurrentWrites(t *testing.T) {
+	out := &syncBuffer{}
+	w := NewMaskWriter(out)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Add("secret", "******")
+			for j := 0; j < 100; j++ {
+				w.Write([]byte("secret\n"))
+			}
+		}()
+	}
+	wg.Wait()
+	w.Close()
+	assert.Equal(t, false, strings.Contains(out.String(), "secret"))
+}
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
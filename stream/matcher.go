@@ -0,0 +1,98 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+// matcher is an Aho-Corasick automaton finding all occurrences of many
+// patterns in one pass over the input.
+type matcher struct {
+	next   []map[byte]int
+	fail   []int
+	depth  []int
+	output [][]int // indexes of patterns ending at the state
+}
+
+type match struct {
+	start   int
+	end     int
+	pattern int
+}
+
+func newMatcher(patterns []string) *matcher {
+	m := &matcher{}
+	m.addState(0)
+	for i, p := range patterns {
+		state := 0
+		for j := 0; j < len(p); j++ {
+			next, ok := m.next[state][p[j]]
+			if !ok {
+				next = m.addState(j + 1)
+				m.next[state][p[j]] = next
+			}
+			state = next
+		}
+		m.output[state] = append(m.output[state], i)
+	}
+
+	var queue []int
+	for _, child := range m.next[0] {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range m.next[state] {
+			queue = append(queue, child)
+			m.fail[child] = m.step(m.fail[state], c)
+			m.output[child] = append(m.output[child], m.output[m.fail[child]]...)
+		}
+	}
+	return m
+}
+
+func (m *matcher) addState(depth int) int {
+	m.next = append(m.next, make(map[byte]int))
+	m.fail = append(m.fail, 0)
+	m.depth = append(m.depth, depth)
+	m.output = append(m.output, nil)
+	return len(m.next) - 1
+}
+
+func (m *matcher) step(state int, c byte) int {
+	for {
+		if next, ok := m.next[state][c]; ok {
+			return next
+		}
+		if state == 0 {
+			return 0
+		}
+		state = m.fail[state]
+	}
+}
+
+// scan returns all matches in data, and the length of the longest suffix
+// of data that is a prefix of some pattern.
+func (m *matcher) scan(data []byte, lengths []int) ([]match, int) {
+	var matches []match
+	state := 0
+	for i, c := range data {
+		state = m.step(state, c)
+		for _, p := range m.output[state] {
+			matches = append(matches, match{i + 1 - lengths[p], i + 1, p})
+		}
+	}
+	return matches, m.depth[state]
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xpath
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+type nodeKind int
+
+const (
+	rootNode nodeKind = iota
+	elementNode
+	attributeNode
+	textNode
+)
+
+// node is a node of the document tree, names are local names as
+// namespaces are not supported. order is the position in document order.
+type node struct {
+	kind     nodeKind
+	name     string
+	data     string
+	order    int
+	parent   *node
+	attrs    []*node
+	children []*node
+}
+
+func parse(r io.Reader) (*node, error) {
+	decoder := xml.NewDecoder(r)
+	root := &node{kind: rootNode}
+	current := root
+	order := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			order++
+			element := &node{kind: elementNode, name: t.Name.Local, order: order, parent: current}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+					continue
+				}
+				order++
+				element.attrs = append(element.attrs, &node{kind: attributeNode, name: attr.Name.Local, data: attr.Value, order: order, parent: element})
+			}
+			current.children = append(current.children, element)
+			current = element
+		case xml.EndElement:
+			current = current.parent
+		case xml.CharData:
+			if current == root {
+				continue
+			}
+			if last := len(current.children) - 1; last >= 0 && current.children[last].kind == textNode {
+				current.children[last].data += string(t)
+				continue
+			}
+			order++
+			current.children = append(current.children, &node{kind: textNode, data: string(t), order: order, parent: current})
+		}
+	}
+	if len(root.children) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return root, nil
+}
+
+func (n *node) value() string {
+	switch n.kind {
+	case attributeNode, textNode:
+		return n.data
+	}
+	var buf bytes.Buffer
+	n.writeText(&buf)
+	return buf.String()
+}
+
+func (n *node) writeText(buf *bytes.Buffer) {
+	for _, child := range n.children {
+		if child.kind == textNode {
+			buf.WriteString(child.data)
+		} else {
+			child.writeText(buf)
+		}
+	}
+}
+
+func (n *node) root() *node {
+	for n.parent != nil {
+		n = n.parent
+	}
+	return n
+}
+
+func (n *node) descendants(nodes []*node) []*node {
+	for _, child := range n.children {
+		nodes = append(nodes, child)
+		nodes = child.descendants(nodes)
+	}
+	return nodes
+}
+
+func (n *node) siblings() []*node {
+	if n.parent == nil || n.kind == attributeNode {
+		return nil
+	}
+	return n.parent.children
+}
@@ -0,0 +1,456 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenLiteral
+	tokenName
+	tokenOperator
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var (
+	operatorNames = map[string]bool{"and": true, "or": true, "div": true, "mod": true}
+	nodeTypes     = map[string]bool{"node": true, "text": true, "comment": true, "processing-instruction": true}
+	axes          = map[string]bool{
+		"ancestor":           true,
+		"ancestor-or-self":   true,
+		"attribute":          true,
+		"child":              true,
+		"descendant":         true,
+		"descendant-or-self": true,
+		"following-sibling":  true,
+		"parent":             true,
+		"preceding-sibling":  true,
+		"self":               true,
+	}
+	unsupportedFunctions = map[string]bool{"namespace-uri": true, "lang": true, "id": true}
+)
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(c) || c == '.' && i+1 < len(s) && isDigit(s[i+1]):
+			j := i + 1
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+				return nil, fmt.Errorf("number %v with exponent at %v is not supported", s[i:j+1], i)
+			}
+			tokens = append(tokens, token{tokenNumber, s[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string literal at %v", i)
+			}
+			tokens = append(tokens, token{tokenLiteral, s[i+1 : i+1+j]})
+			i += j + 2
+		case isNameStart(c):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			if j+1 < len(s) && s[j] == ':' && s[j+1] == '*' {
+				j += 2
+			} else if j+1 < len(s) && s[j] == ':' && isNameStart(s[j+1]) {
+				j += 2
+				for j < len(s) && isNameChar(s[j]) {
+					j++
+				}
+			}
+			name := s[i:j]
+			if operatorNames[name] && operatorAllowed(tokens) {
+				tokens = append(tokens, token{tokenOperator, name})
+			} else {
+				tokens = append(tokens, token{tokenName, name})
+			}
+			i = j
+		default:
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "//", "!=", "<=", ">=":
+					tokens = append(tokens, token{tokenOperator, two})
+					i += 2
+					continue
+				case "::", "..":
+					tokens = append(tokens, token{tokenPunct, two})
+					i += 2
+					continue
+				}
+			}
+			switch c {
+			case '*':
+				if operatorAllowed(tokens) {
+					tokens = append(tokens, token{tokenOperator, "*"})
+				} else {
+					tokens = append(tokens, token{tokenName, "*"})
+				}
+			case '/', '|', '+', '-', '=', '<', '>':
+				tokens = append(tokens, token{tokenOperator, string(c)})
+			case '(', ')', '[', ']', '@', ',', '.':
+				tokens = append(tokens, token{tokenPunct, string(c)})
+			default:
+				return nil, fmt.Errorf("unexpected %q at %v", c, i)
+			}
+			i++
+		}
+	}
+	return append(tokens, token{tokenEOF, ""}), nil
+}
+
+// operatorAllowed tells whether "*" and operator names are operators
+// after tokens, see https://www.w3.org/TR/xpath/#exprlex
+func operatorAllowed(tokens []token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	switch last.kind {
+	case tokenOperator:
+		return false
+	case tokenPunct:
+		return last.text == ")" || last.text == "]" || last.text == "." || last.text == ".."
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c) || c == '-' || c == '.'
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(offset int) token {
+	if p.pos+offset < len(p.tokens) {
+		return p.tokens[p.pos+offset]
+	}
+	return token{tokenEOF, ""}
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(kind tokenKind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && t.text == text
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.is(kind, text) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *parser) parseBinary(operators []string, operand func() (expr, error)) (expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator || !contains(operators, t.text) {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseOr() (expr, error) {
+	return p.parseBinary([]string{"or"}, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	return p.parseBinary([]string{"and"}, p.parseEquality)
+}
+
+func (p *parser) parseEquality() (expr, error) {
+	return p.parseBinary([]string{"=", "!="}, p.parseRelational)
+}
+
+func (p *parser) parseRelational() (expr, error) {
+	return p.parseBinary([]string{"<", "<=", ">", ">="}, p.parseAdditive)
+}
+
+func (p *parser) parseAdditive() (expr, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *parser) parseMultiplicative() (expr, error) {
+	return p.parseBinary([]string{"*", "div", "mod"}, p.parseUnary)
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.is(tokenOperator, "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateExpr{operand}, nil
+	}
+	return p.parseBinary([]string{"|"}, p.parsePath)
+}
+
+func (p *parser) parsePath() (expr, error) {
+	t := p.peek()
+	isFilter := t.kind == tokenNumber || t.kind == tokenLiteral || t.kind == tokenPunct && t.text == "(" ||
+		t.kind == tokenName && p.peekAt(1).text == "(" && p.peekAt(1).kind == tokenPunct && !nodeTypes[t.text]
+	if !isFilter {
+		return p.parseLocationPath()
+	}
+
+	primary, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	predicates, err := p.parsePredicates()
+	if err != nil {
+		return nil, err
+	}
+	var filter expr = primary
+	if len(predicates) > 0 {
+		filter = &filterExpr{primary: primary, predicates: predicates}
+	}
+	if !p.is(tokenOperator, "/") && !p.is(tokenOperator, "//") {
+		return filter, nil
+	}
+	path := &pathExpr{start: filter}
+	if err := p.parseRelativePath(path); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return numberExpr(f), nil
+	case tokenLiteral:
+		return literalExpr(t.text), nil
+	case tokenPunct:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(tokenPunct, ")")
+	}
+	return p.parseFunctionCall(t.text)
+}
+
+func (p *parser) parseFunctionCall(name string) (expr, error) {
+	if unsupportedFunctions[name] {
+		return nil, fmt.Errorf("function %v() is not supported", name)
+	}
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %v()", name)
+	}
+	p.next() // (
+	var args []expr
+	for !p.is(tokenPunct, ")") {
+		if len(args) > 0 {
+			if err := p.expect(tokenPunct, ","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next() // )
+	if len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments for %v()", name)
+	}
+	return &functionExpr{name: name, fn: fn, args: args}, nil
+}
+
+func (p *parser) parsePredicates() ([]expr, error) {
+	var predicates []expr
+	for p.is(tokenPunct, "[") {
+		p.next()
+		predicate, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenPunct, "]"); err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+	return predicates, nil
+}
+
+func (p *parser) parseLocationPath() (expr, error) {
+	path := &pathExpr{}
+	if p.is(tokenOperator, "/") {
+		p.next()
+		path.absolute = true
+		if !p.startsStep() {
+			return path, nil
+		}
+	} else if p.is(tokenOperator, "//") {
+		path.absolute = true
+	} else if !p.startsStep() {
+		return nil, p.unexpected()
+	}
+	if !p.is(tokenOperator, "//") {
+		if err := p.parseStep(path); err != nil {
+			return nil, err
+		}
+	}
+	return path, p.parseRelativePath(path)
+}
+
+func (p *parser) parseRelativePath(path *pathExpr) error {
+	for {
+		if p.is(tokenOperator, "//") {
+			path.steps = append(path.steps, &step{axis: "descendant-or-self", test: "node()"})
+		} else if !p.is(tokenOperator, "/") {
+			return nil
+		}
+		p.next()
+		if err := p.parseStep(path); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) startsStep() bool {
+	t := p.peek()
+	return t.kind == tokenName || t.kind == tokenPunct && (t.text == "@" || t.text == "." || t.text == "..")
+}
+
+func (p *parser) parseStep(path *pathExpr) error {
+	if p.is(tokenPunct, ".") {
+		p.next()
+		path.steps = append(path.steps, &step{axis: "self", test: "node()"})
+		return nil
+	}
+	if p.is(tokenPunct, "..") {
+		p.next()
+		path.steps = append(path.steps, &step{axis: "parent", test: "node()"})
+		return nil
+	}
+
+	s := &step{axis: "child"}
+	if p.is(tokenPunct, "@") {
+		p.next()
+		s.axis = "attribute"
+	} else if p.peek().kind == tokenName && p.peekAt(1).kind == tokenPunct && p.peekAt(1).text == "::" {
+		s.axis = p.next().text
+		if !axes[s.axis] {
+			return fmt.Errorf("axis %v is not supported", s.axis)
+		}
+		p.next()
+	}
+
+	if p.peek().kind != tokenName {
+		return p.unexpected()
+	}
+	t := p.next()
+	if nodeTypes[t.text] && p.is(tokenPunct, "(") {
+		p.next()
+		if err := p.expect(tokenPunct, ")"); err != nil {
+			return err
+		}
+		s.test = t.text + "()"
+	} else if i := strings.IndexByte(t.text, ':'); i >= 0 {
+		s.test = t.text[i+1:]
+	} else {
+		s.test = t.text
+	}
+
+	predicates, err := p.parsePredicates()
+	if err != nil {
+		return err
+	}
+	s.predicates = predicates
+	path.steps = append(path.steps, s)
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,594 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package xpath evaluates a subset of XPath 1.0 expressions against XML
+// documents: location paths, predicates, operators and the node set,
+// string, boolean and number functions. The following and preceding axes,
+// the namespace-uri(), lang() and id() functions and namespaces are not
+// supported, name tests match local names only.
+package xpath
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type Expr struct {
+	source string
+	root   expr
+}
+
+func Compile(s string) (*Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+	return &Expr{source: s, root: root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Evaluate evaluates e against the XML document read from r. It returns
+// the string value of the result and whether anything matched, i.e. the
+// result is a number, string or boolean, or a node set that is not empty.
+func (e *Expr) Evaluate(r io.Reader) (value string, matched bool, err error) {
+	doc, err := parse(r)
+	if err != nil {
+		return "", false, err
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if evalErr, ok := recovered.(evalError); ok {
+				err = evalErr
+			} else {
+				err = fmt.Errorf("evaluate %v failed: %v", e.source, recovered)
+			}
+		}
+	}()
+	result := e.root.eval(context{node: doc, position: 1, size: 1})
+	ns, isNodeSet := result.(nodeSet)
+	return toString(result), !isNodeSet || len(ns) > 0, nil
+}
+
+type evalError string
+
+func (e evalError) Error() string {
+	return string(e)
+}
+
+type context struct {
+	node     *node
+	position int
+	size     int
+}
+
+// expr evaluates to a nodeSet, string, float64 or bool
+type expr interface {
+	eval(ctx context) interface{}
+}
+
+type nodeSet []*node
+
+func (ns nodeSet) Len() int           { return len(ns) }
+func (ns nodeSet) Less(i, j int) bool { return ns[i].order < ns[j].order }
+func (ns nodeSet) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+
+// documentOrder sorts ns in document order and removes duplicates
+func documentOrder(ns nodeSet) nodeSet {
+	sort.Sort(ns)
+	var result nodeSet
+	for i, n := range ns {
+		if i == 0 || n != ns[i-1] {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func nodes(v interface{}) nodeSet {
+	ns, ok := v.(nodeSet)
+	if !ok {
+		panic(evalError("expression does not select nodes"))
+	}
+	return ns
+}
+
+type literalExpr string
+
+func (e literalExpr) eval(ctx context) interface{} {
+	return string(e)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(ctx context) interface{} {
+	return float64(e)
+}
+
+type negateExpr struct {
+	operand expr
+}
+
+func (e *negateExpr) eval(ctx context) interface{} {
+	return -toNumber(e.operand.eval(ctx))
+}
+
+type binaryExpr struct {
+	op    string
+	left  expr
+	right expr
+}
+
+func (e *binaryExpr) eval(ctx context) interface{} {
+	switch e.op {
+	case "or":
+		return toBoolean(e.left.eval(ctx)) || toBoolean(e.right.eval(ctx))
+	case "and":
+		return toBoolean(e.left.eval(ctx)) && toBoolean(e.right.eval(ctx))
+	case "|":
+		left, right := nodes(e.left.eval(ctx)), nodes(e.right.eval(ctx))
+		return documentOrder(append(append(nodeSet{}, left...), right...))
+	case "=", "!=", "<", "<=", ">", ">=":
+		return compare(e.op, e.left.eval(ctx), e.right.eval(ctx))
+	}
+	left, right := toNumber(e.left.eval(ctx)), toNumber(e.right.eval(ctx))
+	switch e.op {
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	case "div":
+		return left / right
+	}
+	return math.Mod(left, right)
+}
+
+type filterExpr struct {
+	primary    expr
+	predicates []expr
+}
+
+func (e *filterExpr) eval(ctx context) interface{} {
+	return filter(nodes(e.primary.eval(ctx)), e.predicates)
+}
+
+func filter(ns nodeSet, predicates []expr) nodeSet {
+	for _, predicate := range predicates {
+		var matched nodeSet
+		for i, n := range ns {
+			v := predicate.eval(context{node: n, position: i + 1, size: len(ns)})
+			if f, ok := v.(float64); ok {
+				if f == float64(i+1) {
+					matched = append(matched, n)
+				}
+			} else if toBoolean(v) {
+				matched = append(matched, n)
+			}
+		}
+		ns = matched
+	}
+	return ns
+}
+
+type pathExpr struct {
+	absolute bool
+	start    expr
+	steps    []*step
+}
+
+func (e *pathExpr) eval(ctx context) interface{} {
+	var ns nodeSet
+	switch {
+	case e.start != nil:
+		ns = nodes(e.start.eval(ctx))
+	case e.absolute:
+		ns = nodeSet{ctx.node.root()}
+	default:
+		ns = nodeSet{ctx.node}
+	}
+	for _, s := range e.steps {
+		var result nodeSet
+		for _, n := range ns {
+			result = append(result, filter(s.selectFrom(n), s.predicates)...)
+		}
+		ns = documentOrder(result)
+	}
+	return ns
+}
+
+type step struct {
+	axis       string
+	test       string
+	predicates []expr
+}
+
+// selectFrom returns nodes on the axis of n matching the node test, in
+// axis order: reverse axes are in reverse document order.
+func (s *step) selectFrom(n *node) nodeSet {
+	var candidates []*node
+	switch s.axis {
+	case "child":
+		candidates = n.children
+	case "attribute":
+		candidates = n.attrs
+	case "descendant":
+		candidates = n.descendants(nil)
+	case "descendant-or-self":
+		candidates = n.descendants([]*node{n})
+	case "self":
+		candidates = []*node{n}
+	case "parent":
+		if n.parent != nil {
+			candidates = []*node{n.parent}
+		}
+	case "ancestor", "ancestor-or-self":
+		start := n.parent
+		if s.axis == "ancestor-or-self" {
+			start = n
+		}
+		for a := start; a != nil; a = a.parent {
+			candidates = append(candidates, a)
+		}
+	case "following-sibling", "preceding-sibling":
+		siblings := n.siblings()
+		for i, sibling := range siblings {
+			if sibling != n {
+				continue
+			}
+			if s.axis == "following-sibling" {
+				candidates = siblings[i+1:]
+			} else {
+				for j := i - 1; j >= 0; j-- {
+					candidates = append(candidates, siblings[j])
+				}
+			}
+		}
+	}
+
+	var matched nodeSet
+	for _, candidate := range candidates {
+		if s.matches(candidate) {
+			matched = append(matched, candidate)
+		}
+	}
+	return matched
+}
+
+func (s *step) matches(n *node) bool {
+	switch s.test {
+	case "node()":
+		return true
+	case "text()":
+		return n.kind == textNode
+	case "comment()", "processing-instruction()":
+		return false
+	}
+	principal := elementNode
+	if s.axis == "attribute" {
+		principal = attributeNode
+	}
+	return n.kind == principal && (s.test == "*" || s.test == n.name)
+}
+
+type function struct {
+	minArgs int
+	maxArgs int // -1 for no limit
+	call    func(ctx context, args []interface{}) interface{}
+}
+
+type functionExpr struct {
+	name string
+	fn   function
+	args []expr
+}
+
+func (e *functionExpr) eval(ctx context) interface{} {
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		args[i] = arg.eval(ctx)
+	}
+	return e.fn.call(ctx, args)
+}
+
+var functions = map[string]function{
+	"last": {0, 0, func(ctx context, args []interface{}) interface{} {
+		return float64(ctx.size)
+	}},
+	"position": {0, 0, func(ctx context, args []interface{}) interface{} {
+		return float64(ctx.position)
+	}},
+	"count": {1, 1, func(ctx context, args []interface{}) interface{} {
+		return float64(len(nodes(args[0])))
+	}},
+	"name":       {0, 1, nodeName},
+	"local-name": {0, 1, nodeName},
+	"string": {0, 1, func(ctx context, args []interface{}) interface{} {
+		return stringArg(ctx, args)
+	}},
+	"concat": {2, -1, func(ctx context, args []interface{}) interface{} {
+		var parts []string
+		for _, arg := range args {
+			parts = append(parts, toString(arg))
+		}
+		return strings.Join(parts, "")
+	}},
+	"starts-with": {2, 2, func(ctx context, args []interface{}) interface{} {
+		return strings.HasPrefix(toString(args[0]), toString(args[1]))
+	}},
+	"contains": {2, 2, func(ctx context, args []interface{}) interface{} {
+		return strings.Contains(toString(args[0]), toString(args[1]))
+	}},
+	"substring-before": {2, 2, func(ctx context, args []interface{}) interface{} {
+		s := toString(args[0])
+		if i := strings.Index(s, toString(args[1])); i >= 0 {
+			return s[:i]
+		}
+		return ""
+	}},
+	"substring-after": {2, 2, func(ctx context, args []interface{}) interface{} {
+		s, sep := toString(args[0]), toString(args[1])
+		if i := strings.Index(s, sep); i >= 0 {
+			return s[i+len(sep):]
+		}
+		return ""
+	}},
+	"substring": {2, 3, func(ctx context, args []interface{}) interface{} {
+		first := round(toNumber(args[1]))
+		last := math.Inf(1)
+		if len(args) == 3 {
+			last = first + round(toNumber(args[2]))
+		}
+		var result []rune
+		for i, r := range []rune(toString(args[0])) {
+			if p := float64(i + 1); p >= first && p < last {
+				result = append(result, r)
+			}
+		}
+		return string(result)
+	}},
+	"string-length": {0, 1, func(ctx context, args []interface{}) interface{} {
+		return float64(utf8.RuneCountInString(stringArg(ctx, args)))
+	}},
+	"normalize-space": {0, 1, func(ctx context, args []interface{}) interface{} {
+		return strings.Join(strings.Fields(stringArg(ctx, args)), " ")
+	}},
+	"translate": {3, 3, func(ctx context, args []interface{}) interface{} {
+		from, to := []rune(toString(args[1])), []rune(toString(args[2]))
+		return strings.Map(func(r rune) rune {
+			for i, f := range from {
+				if f == r {
+					if i < len(to) {
+						return to[i]
+					}
+					return -1
+				}
+			}
+			return r
+		}, toString(args[0]))
+	}},
+	"boolean": {1, 1, func(ctx context, args []interface{}) interface{} {
+		return toBoolean(args[0])
+	}},
+	"not": {1, 1, func(ctx context, args []interface{}) interface{} {
+		return !toBoolean(args[0])
+	}},
+	"true": {0, 0, func(ctx context, args []interface{}) interface{} {
+		return true
+	}},
+	"false": {0, 0, func(ctx context, args []interface{}) interface{} {
+		return false
+	}},
+	"number": {0, 1, func(ctx context, args []interface{}) interface{} {
+		if len(args) == 0 {
+			return toNumber(ctx.node.value())
+		}
+		return toNumber(args[0])
+	}},
+	"sum": {1, 1, func(ctx context, args []interface{}) interface{} {
+		sum := 0.0
+		for _, n := range nodes(args[0]) {
+			sum += toNumber(n.value())
+		}
+		return sum
+	}},
+	"floor": {1, 1, func(ctx context, args []interface{}) interface{} {
+		return math.Floor(toNumber(args[0]))
+	}},
+	"ceiling": {1, 1, func(ctx context, args []interface{}) interface{} {
+		return math.Ceil(toNumber(args[0]))
+	}},
+	"round": {1, 1, func(ctx context, args []interface{}) interface{} {
+		return round(toNumber(args[0]))
+	}},
+}
+
+func nodeName(ctx context, args []interface{}) interface{} {
+	ns := nodeSet{ctx.node}
+	if len(args) == 1 {
+		ns = nodes(args[0])
+	}
+	if len(ns) == 0 {
+		return ""
+	}
+	return ns[0].name
+}
+
+func stringArg(ctx context, args []interface{}) string {
+	if len(args) == 0 {
+		return ctx.node.value()
+	}
+	return toString(args[0])
+}
+
+func round(f float64) float64 {
+	return math.Floor(f + 0.5)
+}
+
+func compare(op string, left, right interface{}) bool {
+	leftNodes, leftIsNodes := left.(nodeSet)
+	rightNodes, rightIsNodes := right.(nodeSet)
+	switch {
+	case leftIsNodes && rightIsNodes:
+		for _, l := range leftNodes {
+			for _, r := range rightNodes {
+				if compareValues(op, l.value(), r.value()) {
+					return true
+				}
+			}
+		}
+		return false
+	case leftIsNodes:
+		if b, ok := right.(bool); ok {
+			return compareValues(op, len(leftNodes) > 0, b)
+		}
+		for _, l := range leftNodes {
+			if compareValues(op, valueAs(l, right), right) {
+				return true
+			}
+		}
+		return false
+	case rightIsNodes:
+		if b, ok := left.(bool); ok {
+			return compareValues(op, b, len(rightNodes) > 0)
+		}
+		for _, r := range rightNodes {
+			if compareValues(op, left, valueAs(r, left)) {
+				return true
+			}
+		}
+		return false
+	}
+	return compareValues(op, left, right)
+}
+
+// valueAs returns the value of n as number when other is number
+func valueAs(n *node, other interface{}) interface{} {
+	if _, ok := other.(float64); ok {
+		return toNumber(n.value())
+	}
+	return n.value()
+}
+
+func compareValues(op string, left, right interface{}) bool {
+	if op == "=" || op == "!=" {
+		var equal bool
+		_, leftIsBool := left.(bool)
+		_, rightIsBool := right.(bool)
+		_, leftIsNumber := left.(float64)
+		_, rightIsNumber := right.(float64)
+		switch {
+		case leftIsBool || rightIsBool:
+			equal = toBoolean(left) == toBoolean(right)
+		case leftIsNumber || rightIsNumber:
+			equal = toNumber(left) == toNumber(right)
+		default:
+			equal = toString(left) == toString(right)
+		}
+		return equal == (op == "=")
+	}
+	l, r := toNumber(left), toNumber(right)
+	switch op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
+
+var numberPattern = regexp.MustCompile(`^-?(\d+(\.\d*)?|\.\d+)$`)
+
+func toNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+	s := strings.TrimSpace(toString(v))
+	if !numberPattern.MatchString(s) {
+		return math.NaN()
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case nodeSet:
+		if len(v) > 0 {
+			return v[0].value()
+		}
+	}
+	return ""
+}
+
+func toBoolean(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case nodeSet:
+		return len(v) > 0
+	}
+	return false
+}
+
+func formatNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == math.Trunc(f) && math.Abs(f) < 1e15:
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
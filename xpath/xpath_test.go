@@ -0,0 +1,161 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xpath_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/xpath"
+	"github.com/xli/assert"
+	"strings"
+	"testing"
+)
+
+const coverage = `<?xml version="1.0"?>
+<report xmlns="http://example.com/coverage">
+  <stats>
+    <packages value="2"/>
+    <classes value="12"/>
+  </stats>
+  <data>
+    <all name="all classes">
+      <coverage type="class, %" value="83%  (10/12)"/>
+      <coverage type="method, %" value="71%  (45/63)"/>
+      <coverage type="line, %" value="65%  (325/500)"/>
+    </all>
+  </data>
+  <version>1.<![CDATA[2]]>.3</version>
+</report>`
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expr  string
+		value string
+	}{
+		{"/report/version", "1.2.3"},
+		{"/report/version/text()", "1.2.3"},
+		{"//packages/@value", "2"},
+		{"/report/stats/*[2]/@value", "12"},
+		{"//coverage[@type='method, %']/@value", "71%  (45/63)"},
+		{"substring-before(//coverage[starts-with(@type, 'class')]/@value, '%')", "83"},
+		{"//coverage[last()]/@type", "line, %"},
+		{"count(//coverage)", "3"},
+		{"sum(//stats/*/@value) * 2", "28"},
+		{"//classes/@value div 8", "1.5"},
+		{"//classes/@value > 10", "true"},
+		{"//coverage/@value = '65%  (325/500)'", "true"},
+		{"name(/*)", "report"},
+		{"//all/attribute::name", "all classes"},
+		{"//coverage[2]/preceding-sibling::coverage/@type", "class, %"},
+		{"//coverage[1]/following-sibling::*[1]/@type", "method, %"},
+		{"//packages/ancestor::report/version", "1.2.3"},
+		{"//packages/../classes/@value", "12"},
+		{"(//coverage/@type)[2]", "method, %"},
+		{"(//coverage | //packages)[1]/@value", "2"},
+		{"concat('v', translate(/report/version, '.', '-'))", "v1-2-3"},
+		{"normalize-space('  a   b ')", "a b"},
+		{"substring('12345', 1.5, 2.6)", "234"},
+		{"round(2.5) + floor(-1.5) - ceiling(0.2) + 1", "1"},
+		{"string-length(//all/@name)", "11"},
+		{"-//packages/@value mod 3", "-2"},
+		{"not(//missing) and true()", "true"},
+		{"1 div 0", "Infinity"},
+	}
+	for _, test := range tests {
+		expr, err := Compile(test.expr)
+		assert.Nil(t, err, test.expr)
+		value, matched, err := expr.Evaluate(strings.NewReader(coverage))
+		assert.Nil(t, err, test.expr)
+		assert.Equal(t, test.value, value, test.expr)
+		assert.Equal(t, true, matched, test.expr)
+	}
+}
+
+func TestEvaluateNothingMatched(t *testing.T) {
+	for _, expr := range []string{"//missing", "//coverage[4]/@value", "//missing | //coverage[4]"} {
+		value, matched, err := mustCompile(t, expr).Evaluate(strings.NewReader(coverage))
+		assert.Nil(t, err, expr)
+		assert.Equal(t, false, matched, expr)
+		assert.Equal(t, "", value, expr)
+	}
+}
+
+func TestEvaluateFalsyValuesMatched(t *testing.T) {
+	var tests = []struct {
+		expr  string
+		value string
+	}{
+		{"count(//missing)", "0"},
+		{"sum(//missing/@value)", "0"},
+		{"1 = 2", "false"},
+		{"number('x')", "NaN"},
+		{"substring-before('abc', 'x')", ""},
+	}
+	for _, test := range tests {
+		value, matched, err := mustCompile(t, test.expr).Evaluate(strings.NewReader(coverage))
+		assert.Nil(t, err, test.expr)
+		assert.Equal(t, true, matched, test.expr)
+		assert.Equal(t, test.value, value, test.expr)
+	}
+}
+
+func TestCompileIllegalExpression(t *testing.T) {
+	for _, expr := range []string{"", "//", "/report[", "foo(1)", "substring('a')", "'abc", "unknown::node()", "1 +", "/report)"} {
+		_, err := Compile(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestCompileUnsupportedExpression(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"//stats/following::classes", "axis following is not supported"},
+		{"//classes/preceding::packages", "axis preceding is not supported"},
+		{"namespace-uri(/*)", "function namespace-uri() is not supported"},
+		{"lang('en')", "function lang() is not supported"},
+		{"id('x')", "function id() is not supported"},
+		{"1e3", "number 1e with exponent at 0 is not supported"},
+		{"//classes/@value > 1.5E2", "number 1.5E with exponent at 19 is not supported"},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.expr)
+		assert.NotNil(t, err, test.expr)
+		if err != nil {
+			assert.Equal(t, test.err, err.Error(), test.expr)
+		}
+	}
+}
+
+func TestEvaluateInvalidDocument(t *testing.T) {
+	_, _, err := mustCompile(t, "/report").Evaluate(strings.NewReader("<report>"))
+	assert.NotNil(t, err)
+	_, _, err = mustCompile(t, "/report").Evaluate(strings.NewReader(""))
+	assert.NotNil(t, err)
+}
+
+func TestEvaluateExpressionNotSelectingNodes(t *testing.T) {
+	_, _, err := mustCompile(t, "count('abc')").Evaluate(strings.NewReader(coverage))
+	assert.NotNil(t, err)
+	_, _, err = mustCompile(t, "('abc')/foo").Evaluate(strings.NewReader(coverage))
+	assert.NotNil(t, err)
+}
+
+func mustCompile(t *testing.T, s string) *Expr {
+	expr, err := Compile(s)
+	assert.Nil(t, err, s)
+	return expr
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ziputil zips and extracts files keeping unix permissions and
+// symbolic links, extraction never writes outside of the destination.
+package ziputil
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy decides what Extract does with symbolic link entries.
+type SymlinkPolicy int
+
+const (
+	// SymlinkInside creates symbolic links whose target is inside of the
+	// destination and fails on the others.
+	SymlinkInside SymlinkPolicy = iota
+	// SymlinkSkip ignores symbolic links.
+	SymlinkSkip
+	// SymlinkReject fails on any symbolic link.
+	SymlinkReject
+)
+
+const creatorUnix = 3
+
+// Add writes file path into w as entry name, with permissions of the file
+// and, when it is a symbolic link, the link itself instead of its target.
+func Add(w *zip.Writer, path, name string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		writer, err := w.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(writer, filepath.ToSlash(target))
+		return err
+	}
+	// zip.Writer switches to zip64 for files over 4GB
+	header.Method = zip.Deflate
+	writer, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// ExtractFile extracts zip file zipfile into destDir.
+func ExtractFile(zipfile, destDir string, policy SymlinkPolicy) error {
+	r, err := zip.OpenReader(zipfile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return Extract(&r.Reader, destDir, policy)
+}
+
+// Extract extracts all entries of r into destDir, it fails on entries
+// that would be written outside of destDir. Permissions recorded by unix
+// zip tools are restored.
+func Extract(r *zip.Reader, destDir string, policy SymlinkPolicy) error {
+	destDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	// links are resolved against the real destination
+	if destDir, err = filepath.EvalSymlinks(destDir); err != nil {
+		return err
+	}
+	var links []string
+	for _, file := range r.File {
+		dest, err := destPath(destDir, file.Name)
+		if err != nil {
+			return err
+		}
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			if err = resolveInside(destDir, dest, file.Name); err == nil {
+				err = os.MkdirAll(dest, 0755)
+			}
+		case mode&os.ModeSymlink != 0:
+			err = extractSymlink(file, destDir, dest, policy)
+			if err == nil && policy == SymlinkInside {
+				links = append(links, dest)
+				err = checkLinks(destDir, links, file.Name)
+			}
+		default:
+			err = extractFile(file, destDir, dest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func destPath(destDir, name string) (string, error) {
+	dest := filepath.Join(destDir, name)
+	if !inside(destDir, dest) {
+		return "", fmt.Errorf("zip entry %v is outside of %v", name, destDir)
+	}
+	return dest, nil
+}
+
+func inside(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// resolveInside checks that path, following the symbolic links extracted
+// so far, does not lead outside of destDir.
+func resolveInside(destDir, path, name string) error {
+	resolved, err := realPath(path)
+	if err != nil {
+		return err
+	}
+	if !inside(destDir, resolved) {
+		return fmt.Errorf("zip entry %v is outside of %v through a symbolic link", name, destDir)
+	}
+	return nil
+}
+
+// checkLinks checks that the links extracted so far still resolve inside of
+// destDir, the last one, which is removed when it fails, may have changed
+// where the others lead to.
+func checkLinks(destDir string, links []string, name string) error {
+	for _, link := range links {
+		if err := resolveInside(destDir, link, name); err != nil {
+			os.Remove(links[len(links)-1])
+			return err
+		}
+	}
+	return nil
+}
+
+// realPath resolves the symbolic links in absolute path like
+// filepath.EvalSymlinks, but the parts of path that do not exist (yet) are
+// cleaned lexically, as they will be once created as directories.
+func realPath(path string) (string, error) {
+	volume := filepath.VolumeName(path)
+	resolved := volume + string(os.PathSeparator)
+	rest := path[len(volume):]
+	for links := 0; rest != ""; {
+		name := rest
+		rest = ""
+		if i := strings.IndexRune(name, os.PathSeparator); i >= 0 {
+			name, rest = name[:i], name[i+1:]
+		}
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(next)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in %v", path)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			volume = filepath.VolumeName(target)
+			resolved = volume + string(os.PathSeparator)
+			target = target[len(volume):]
+		}
+		rest = target + string(os.PathSeparator) + rest
+	}
+	return resolved, nil
+}
+
+func extractFile(file *zip.File, destDir, dest string) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := resolveInside(destDir, filepath.Dir(dest), file.Name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// replace files instead of writing through symbolic or hard links
+	if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	if _, err = io.Copy(destFile, rc); err != nil {
+		return err
+	}
+	if file.CreatorVersion>>8 == creatorUnix {
+		return destFile.Chmod(file.Mode().Perm())
+	}
+	return nil
+}
+
+func extractSymlink(file *zip.File, destDir, dest string, policy SymlinkPolicy) error {
+	switch policy {
+	case SymlinkSkip:
+		return nil
+	case SymlinkReject:
+		return fmt.Errorf("zip entry %v is a symbolic link", file.Name)
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	target := filepath.FromSlash(string(bs))
+	if err := resolveInside(destDir, filepath.Dir(dest), file.Name); err != nil {
+		return err
+	}
+	// the target is relative to the real directory of the link
+	parent, err := realPath(filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(target) || !inside(destDir, filepath.Join(parent, target)) {
+		return fmt.Errorf("zip entry %v links to %v outside of %v", file.Name, target, destDir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Symlink(target, dest)
+}
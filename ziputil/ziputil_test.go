@@ -0,0 +1,214 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ziputil_test
+
+import (
+	"archive/zip"
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/ziputil"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoundTripKeepsModesAndSymlinks(t *testing.T) {
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	writeFile(t, filepath.Join(src, "bin/tool"), "#!/bin/sh\n", 0755)
+	writeFile(t, filepath.Join(src, "secret.txt"), "secret", 0600)
+	assert.Nil(t, os.Symlink("bin/tool", filepath.Join(src, "tool")))
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"bin/tool", "secret.txt", "tool"} {
+		assert.Nil(t, Add(w, filepath.Join(src, name), name))
+	}
+	assert.Nil(t, w.Close())
+
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+	assert.Nil(t, Extract(reader(t, buf.Bytes()), dest, SymlinkInside))
+
+	assertMode(t, filepath.Join(dest, "bin/tool"), 0755)
+	assertMode(t, filepath.Join(dest, "secret.txt"), 0600)
+	target, err := os.Readlink(filepath.Join(dest, "tool"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bin/tool", target)
+	content, err := ioutil.ReadFile(filepath.Join(dest, "tool"))
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\n", string(content))
+}
+
+func TestExtractRejectsEntriesOutsideOfDestination(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "a/../../evil.txt", "a/../../../tmp/evil.txt"} {
+		dest := tempDir(t)
+		zipped := zipEntries(t, map[string]string{name: "evil"}, nil)
+		err := Extract(reader(t, zipped), filepath.Join(dest, "dest"), SymlinkInside)
+		assert.NotNil(t, err, name)
+		assert.True(t, strings.Contains(err.Error(), "is outside of"), err)
+		_, err = os.Stat(filepath.Join(dest, "evil.txt"))
+		assert.True(t, os.IsNotExist(err), name)
+		os.RemoveAll(dest)
+	}
+
+	// each link is inside of the destination on its own, but the chain is not
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, link := range [][]string{{"a/b", ".."}, {"a/b/c", ".."}} {
+		header := &zip.FileHeader{Name: link[0]}
+		header.SetMode(os.ModeSymlink | 0777)
+		writer, err := w.CreateHeader(header)
+		assert.Nil(t, err)
+		writer.Write([]byte(link[1]))
+	}
+	writer, err := w.Create("a/b/c/evil.txt")
+	assert.Nil(t, err)
+	writer.Write([]byte("evil"))
+	assert.Nil(t, w.Close())
+
+	err = Extract(reader(t, buf.Bytes()), filepath.Join(dest, "dest"), SymlinkInside)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "outside of"), err)
+	_, err = os.Stat(filepath.Join(dest, "evil.txt"))
+	assert.True(t, os.IsNotExist(err), "evil.txt is not written outside of the destination")
+}
+
+func TestExtractRejectsLinkChangingWhereEarlierLinksLead(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	// l1 is inside while x does not exist, x -> . makes it lead to the parent
+	for _, link := range [][]string{{"l1", "x/.."}, {"x", "."}} {
+		header := &zip.FileHeader{Name: link[0]}
+		header.SetMode(os.ModeSymlink | 0777)
+		writer, err := w.CreateHeader(header)
+		assert.Nil(t, err)
+		writer.Write([]byte(link[1]))
+	}
+	writer, err := w.Create("l1/evil.txt")
+	assert.Nil(t, err)
+	writer.Write([]byte("evil"))
+	assert.Nil(t, w.Close())
+
+	err = Extract(reader(t, buf.Bytes()), filepath.Join(dest, "dest"), SymlinkInside)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "zip entry x is outside of"), err)
+	_, err = os.Lstat(filepath.Join(dest, "dest", "x"))
+	assert.True(t, os.IsNotExist(err), "link x is removed")
+	_, err = os.Stat(filepath.Join(dest, "evil.txt"))
+	assert.True(t, os.IsNotExist(err), "evil.txt is not written outside of the destination")
+}
+
+func TestExtractSymlinkPolicies(t *testing.T) {
+	inside := zipEntries(t, map[string]string{"a.txt": "a"}, map[string]string{"link": "a.txt"})
+	outside := zipEntries(t, nil, map[string]string{"link": "../../etc/passwd"})
+	absolute := zipEntries(t, nil, map[string]string{"link": "/etc/passwd"})
+	var tests = []struct {
+		zipped []byte
+		policy SymlinkPolicy
+		err    string
+		link   bool
+	}{
+		{inside, SymlinkInside, "", true},
+		{inside, SymlinkSkip, "", false},
+		{inside, SymlinkReject, "link is a symbolic link", false},
+		{outside, SymlinkInside, "links to ../../etc/passwd outside of", false},
+		{outside, SymlinkSkip, "", false},
+		{absolute, SymlinkInside, "links to /etc/passwd outside of", false},
+	}
+	for _, test := range tests {
+		dest := tempDir(t)
+		err := Extract(reader(t, test.zipped), dest, test.policy)
+		if test.err == "" {
+			assert.Nil(t, err)
+		} else {
+			assert.NotNil(t, err)
+			assert.True(t, strings.Contains(err.Error(), test.err), err)
+		}
+		_, err = os.Lstat(filepath.Join(dest, "link"))
+		assert.Equal(t, test.link, err == nil, test)
+		os.RemoveAll(dest)
+	}
+}
+
+func TestExtractDoesNotWriteThroughExistingSymlink(t *testing.T) {
+	dest := tempDir(t)
+	defer os.RemoveAll(dest)
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+	writeFile(t, filepath.Join(outside, "target.txt"), "untouched", 0644)
+	assert.Nil(t, os.Symlink(filepath.Join(outside, "target.txt"), filepath.Join(dest, "file.txt")))
+
+	zipped := zipEntries(t, map[string]string{"file.txt": "extracted"}, nil)
+	assert.Nil(t, Extract(reader(t, zipped), dest, SymlinkInside))
+
+	content, err := ioutil.ReadFile(filepath.Join(outside, "target.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "untouched", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(dest, "file.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "extracted", string(content))
+}
+
+func zipEntries(t *testing.T, files, links map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		writer, err := w.Create(name)
+		assert.Nil(t, err)
+		writer.Write([]byte(content))
+	}
+	for name, target := range links {
+		header := &zip.FileHeader{Name: name}
+		header.SetMode(os.ModeSymlink | 0777)
+		writer, err := w.CreateHeader(header)
+		assert.Nil(t, err)
+		writer.Write([]byte(target))
+	}
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func reader(t *testing.T, zipped []byte) *zip.Reader {
+	r, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	assert.Nil(t, err)
+	return r
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ziputil")
+	assert.Nil(t, err)
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), mode))
+	assert.Nil(t, os.Chmod(path, mode))
+}
+
+func assertMode(t *testing.T, path string, mode os.FileMode) {
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, mode, info.Mode().Perm(), path)
+}